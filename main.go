@@ -2,11 +2,12 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"os"
 	"regexp"
 
 	// Plugins
-	_ "github.com/lucaslorentz/caddy-docker-proxy/plugin"
+	"github.com/lucaslorentz/caddy-docker-proxy/plugin"
 
 	// DNS Providers
 	_ "github.com/caddyserver/dnsproviders/azure"
@@ -24,13 +25,33 @@ import (
 )
 
 var enableTelemetryFlag bool
+var generateFlag bool
+var dumpSnapshotFlag bool
 var isTrue = regexp.MustCompile("(?i)^(true|yes|1)$")
 
 func main() {
 	flag.BoolVar(&enableTelemetryFlag, "enable-telemetry", false, "Enable caddy telemetry")
+	flag.BoolVar(&generateFlag, "docker-generate", false, "Print caddyfile generated from docker and exit, without starting caddy")
+	flag.BoolVar(&dumpSnapshotFlag, "docker-dump-snapshot", false, "Print a JSON snapshot of docker state and exit, without starting caddy")
 
 	flag.Parse()
 
+	if generateFlag {
+		if err := plugin.GenerateOnce(os.Stdout, os.Stderr); err != nil {
+			fmt.Fprintf(os.Stderr, "[ERROR] %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if dumpSnapshotFlag {
+		if err := plugin.DumpSnapshot(os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "[ERROR] %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	if enableTelemetryEnv := os.Getenv("CADDY_ENABLE_TELEMETRY"); enableTelemetryEnv != "" {
 		caddymain.EnableTelemetry = isTrue.MatchString(enableTelemetryEnv)
 	} else {
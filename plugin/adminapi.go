@@ -0,0 +1,140 @@
+package plugin
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+type adminRejectedCaddyfile struct {
+	Time      time.Time `json:"time"`
+	Caddyfile string    `json:"caddyfile"`
+	Error     string    `json:"error"`
+}
+
+type adminDockerStatus struct {
+	GeneratedAt time.Time             `json:"generatedAt"`
+	Reload      ReloadStatus          `json:"reload"`
+	Endpoints   []adminEndpointStatus `json:"endpoints"`
+}
+
+type adminEndpointStatus struct {
+	Name           string       `json:"name,omitempty"`
+	SwarmAvailable bool         `json:"swarmAvailable"`
+	CaddyNetworks  []string     `json:"caddyNetworks"`
+	Events         EventsStatus `json:"events"`
+}
+
+type adminDirective struct {
+	Name     string            `json:"name,omitempty"`
+	Args     []string          `json:"args,omitempty"`
+	Hosts    []string          `json:"hosts,omitempty"`
+	Sources  []string          `json:"sources,omitempty"`
+	Children []*adminDirective `json:"children,omitempty"`
+}
+
+// serveAdminAPI serves read-only admin HTTP API at address
+func (dockerLoader *DockerLoader) serveAdminAPI(address string) {
+	log.Printf("[INFO] Docker admin API listening on %v\n", address)
+	err := http.ListenAndServe(address, dockerLoader.createAdminHandler())
+	log.Printf("[ERROR] Docker admin API failed: %v\n", err)
+}
+
+func (dockerLoader *DockerLoader) createAdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/caddyfile", dockerLoader.handleAdminCaddyfile)
+	mux.HandleFunc("/caddyfile/rejected", dockerLoader.handleAdminRejectedCaddyfile)
+	mux.HandleFunc("/logs", dockerLoader.handleAdminLogs)
+	mux.HandleFunc("/docker", dockerLoader.handleAdminDocker)
+	mux.HandleFunc("/directives", dockerLoader.handleAdminDirectives)
+	mux.HandleFunc("/metrics", handleMetrics)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "admin API is read-only", http.StatusMethodNotAllowed)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func (dockerLoader *DockerLoader) handleAdminCaddyfile(w http.ResponseWriter, r *http.Request) {
+	writeAdminText(w, string(dockerLoader.getInput().Contents))
+}
+
+func (dockerLoader *DockerLoader) handleAdminRejectedCaddyfile(w http.ResponseWriter, r *http.Request) {
+	rejected := dockerLoader.getGenerationStatus().rejected
+	if rejected.time.IsZero() {
+		http.Error(w, "no caddyfile was rejected", http.StatusNotFound)
+		return
+	}
+	writeAdminJSON(w, adminRejectedCaddyfile{
+		Time:      rejected.time,
+		Caddyfile: string(rejected.caddyfile),
+		Error:     rejected.err,
+	})
+}
+
+func (dockerLoader *DockerLoader) handleAdminLogs(w http.ResponseWriter, r *http.Request) {
+	writeAdminText(w, dockerLoader.getGenerationStatus().logs)
+}
+
+func (dockerLoader *DockerLoader) handleAdminDocker(w http.ResponseWriter, r *http.Request) {
+	generation := dockerLoader.getGenerationStatus()
+
+	status := adminDockerStatus{
+		GeneratedAt: generation.time,
+		Reload:      dockerLoader.ReloadStatus(),
+		Endpoints:   []adminEndpointStatus{},
+	}
+	for i, endpoint := range dockerLoader.endpoints {
+		endpointStatus := adminEndpointStatus{
+			Name:          endpoint.name,
+			CaddyNetworks: []string{},
+			Events:        dockerLoader.endpointEventsStatus(endpoint),
+		}
+		// endpoints status is only known after the first generation
+		if i < len(generation.endpoints) {
+			endpointStatus.SwarmAvailable = generation.endpoints[i].swarmAvailable
+			endpointStatus.CaddyNetworks = generation.endpoints[i].caddyNetworks
+		}
+		status.Endpoints = append(status.Endpoints, endpointStatus)
+	}
+
+	writeAdminJSON(w, status)
+}
+
+func (dockerLoader *DockerLoader) handleAdminDirectives(w http.ResponseWriter, r *http.Request) {
+	writeAdminJSON(w, convertAdminDirectives(dockerLoader.getGenerationStatus().directives))
+}
+
+func convertAdminDirectives(directives map[string]*directiveData) []*adminDirective {
+	result := []*adminDirective{}
+	for _, name := range getSortedKeys(directives) {
+		directive := directives[name]
+		result = append(result, &adminDirective{
+			Name:     directive.name,
+			Args:     directive.args,
+			Hosts:    directive.hosts,
+			Sources:  directive.sources,
+			Children: convertAdminDirectives(directive.children),
+		})
+	}
+	return result
+}
+
+func writeAdminText(w http.ResponseWriter, text string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(text))
+}
+
+func writeAdminJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(value); err != nil {
+		log.Printf("[ERROR] Docker admin API failed to encode response: %v\n", err)
+	}
+}
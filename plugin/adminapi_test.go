@@ -0,0 +1,95 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminAPI_ExposesGenerationState(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	container := createTestContainer("container-id", "service.testdomain.com")
+	container.Names = []string{"/service"}
+	dockerClient.ContainersData = []types.Container{container}
+
+	var reloads int32
+	loader := createTestLoader(dockerClient, &reloads)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	loader.run(ctx, false)
+
+	handler := loader.createAdminHandler()
+
+	response := serveAdminRequest(handler, http.MethodGet, "/caddyfile")
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, string(loader.getInput().Contents), response.Body.String())
+
+	response = serveAdminRequest(handler, http.MethodGet, "/logs")
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, skipCaddyfileText, response.Body.String())
+
+	response = serveAdminRequest(handler, http.MethodGet, "/caddyfile/rejected")
+	assert.Equal(t, http.StatusNotFound, response.Code)
+
+	response = serveAdminRequest(handler, http.MethodGet, "/directives")
+	assert.Equal(t, http.StatusOK, response.Code)
+	var directives []adminDirective
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &directives))
+	assert.Len(t, directives, 1)
+	assert.Equal(t, []string{"service.testdomain.com"}, directives[0].Args)
+	assert.Equal(t, []string{"container service (container-id)"}, directives[0].Sources)
+
+	response = serveAdminRequest(handler, http.MethodGet, "/docker")
+	assert.Equal(t, http.StatusOK, response.Code)
+	var status adminDockerStatus
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &status))
+	assert.Len(t, status.Endpoints, 1)
+	assert.True(t, status.Endpoints[0].SwarmAvailable)
+	assert.Equal(t, []string{caddyNetworkID}, status.Endpoints[0].CaddyNetworks)
+}
+
+func TestAdminAPI_ExposesRejectedCaddyfile(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ContainersData = []types.Container{
+		types.Container{
+			ID: "container-id",
+			Labels: map[string]string{
+				fmtLabel("%s"):             "service.testdomain.com",
+				fmtLabel("%s.unknown_dir"): "value",
+			},
+		},
+	}
+
+	var reloads int32
+	loader := createTestLoader(dockerClient, &reloads)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	loader.run(ctx, false)
+
+	response := serveAdminRequest(loader.createAdminHandler(), http.MethodGet, "/caddyfile/rejected")
+	assert.Equal(t, http.StatusOK, response.Code)
+	var rejected adminRejectedCaddyfile
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &rejected))
+	assert.Contains(t, rejected.Caddyfile, "unknown_dir value")
+	assert.NotEmpty(t, rejected.Error)
+}
+
+func TestAdminAPI_IsReadOnly(t *testing.T) {
+	loader := CreateDockerLoader()
+
+	response := serveAdminRequest(loader.createAdminHandler(), http.MethodPost, "/caddyfile")
+	assert.Equal(t, http.StatusMethodNotAllowed, response.Code)
+}
+
+func serveAdminRequest(handler http.Handler, method string, path string) *httptest.ResponseRecorder {
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, httptest.NewRequest(method, path, nil))
+	return response
+}
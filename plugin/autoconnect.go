@@ -0,0 +1,208 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+)
+
+// networkRef is a docker network a proxy target is attached to
+type networkRef struct {
+	id   string
+	name string
+}
+
+// parseNetworkPatterns parses network name patterns separated by spaces or commas, skipping invalid ones
+func parseNetworkPatterns(text string) []string {
+	patterns := []string{}
+	for _, pattern := range eventPatternsSeparator.Split(strings.TrimSpace(text), -1) {
+		if pattern == "" {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			log.Printf("[ERROR] Invalid network pattern %v: %v", pattern, err)
+			continue
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns
+}
+
+// isConnectNetwork tells if caddy container is allowed to connect to network
+func (g *CaddyfileGenerator) isConnectNetwork(name string) bool {
+	for _, pattern := range g.connectNetworks {
+		if matches, _ := path.Match(pattern, name); matches {
+			return true
+		}
+	}
+	return false
+}
+
+// connectTargetNetworks connects caddy container to an allowed network of each target that doesn't share a network with caddy.
+// When enabled, caddy is disconnected from allowed networks without targets, unless caddy was started with them.
+func (g *CaddyfileGenerator) connectTargetNetworks(logsBuffer *bytes.Buffer) {
+	containerID, err := g.dockerUtils.GetCurrentContainerID()
+	if err != nil {
+		g.logError(logsBuffer, err)
+		return
+	}
+
+	targetsNetworks, err := g.getTargetsNetworks(containerID)
+	if err != nil {
+		g.logError(logsBuffer, err)
+		return
+	}
+
+	ctx := context.Background()
+	routedNetworks := map[string]bool{}
+
+	for _, target := range getSortedTargets(targetsNetworks) {
+		networks := targetsNetworks[target]
+		shared := false
+		for _, network := range networks {
+			if g.caddyNetworks[network.id] {
+				routedNetworks[network.id] = true
+				shared = true
+			}
+		}
+		if shared {
+			continue
+		}
+
+		for _, network := range networks {
+			connectKey := containerID + "/" + network.id
+			if !g.isConnectNetwork(network.name) || g.failedConnects[connectKey] {
+				continue
+			}
+			if err := g.dockerClient.NetworkConnect(ctx, network.id, containerID, nil); err != nil {
+				g.logError(logsBuffer, fmt.Errorf("Failed to connect caddy to network %v of %v, retrying after next container or network event: %v", network.name, target, err))
+				if g.failedConnects == nil {
+					g.failedConnects = map[string]bool{}
+				}
+				g.failedConnects[connectKey] = true
+				continue
+			}
+			g.logInfo(logsBuffer, fmt.Sprintf("Connected caddy to network %v of %v", network.name, target))
+			g.caddyNetworks[network.id] = true
+			routedNetworks[network.id] = true
+			break
+		}
+	}
+
+	if !g.disconnectNetworks {
+		return
+	}
+
+	for _, networkID := range getSortedNetworks(g.caddyNetworks) {
+		if routedNetworks[networkID] || g.initialCaddyNetworks[networkID] {
+			continue
+		}
+		networkInfo, err := g.dockerClient.NetworkInspect(ctx, networkID, types.NetworkInspectOptions{})
+		if err != nil {
+			g.logError(logsBuffer, err)
+			continue
+		}
+		if !g.isConnectNetwork(networkInfo.Name) {
+			continue
+		}
+		if err := g.dockerClient.NetworkDisconnect(ctx, networkID, containerID, false); err != nil {
+			g.logError(logsBuffer, fmt.Errorf("Failed to disconnect caddy from network %v: %v", networkInfo.Name, err))
+			continue
+		}
+		g.logInfo(logsBuffer, fmt.Sprintf("Disconnected caddy from network %v without targets", networkInfo.Name))
+		delete(g.caddyNetworks, networkID)
+	}
+}
+
+// forgetFailedConnects makes next generation try again the networks caddy failed to connect to,
+// failures are remembered so the same error isn't logged on every generation
+func (g *CaddyfileGenerator) forgetFailedConnects() {
+	g.failedConnects = nil
+}
+
+// getTargetsNetworks returns the networks of each container and service with labels, sorted by network name
+func (g *CaddyfileGenerator) getTargetsNetworks(caddyContainerID string) (map[string][]networkRef, error) {
+	targetsNetworks := map[string][]networkRef{}
+
+	containers, err := g.dockerClient.ContainerList(context.Background(), types.ContainerListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for _, container := range containers {
+		if container.ID == caddyContainerID || !g.hasLabels(container.Labels) || container.NetworkSettings == nil {
+			continue
+		}
+		networks := []networkRef{}
+		for name, settings := range container.NetworkSettings.Networks {
+			networks = append(networks, networkRef{id: settings.NetworkID, name: name})
+		}
+		targetsNetworks[getContainerSource(&container)] = sortNetworkRefs(networks)
+	}
+
+	if !g.swarmIsAvailable {
+		return targetsNetworks, nil
+	}
+
+	services, err := g.dockerClient.ServiceList(context.Background(), types.ServiceListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for _, service := range services {
+		if !g.hasLabels(service.Spec.Labels) {
+			continue
+		}
+		networks := []networkRef{}
+		for _, attachment := range service.Spec.TaskTemplate.Networks {
+			networkInfo, err := g.dockerClient.NetworkInspect(context.Background(), attachment.Target, types.NetworkInspectOptions{})
+			if err != nil {
+				return nil, err
+			}
+			if networkInfo.Ingress {
+				continue
+			}
+			networkID := attachment.Target
+			if networkInfo.ID != "" {
+				networkID = networkInfo.ID
+			}
+			networks = append(networks, networkRef{id: networkID, name: networkInfo.Name})
+		}
+		targetsNetworks[getServiceSource(&service)] = sortNetworkRefs(networks)
+	}
+
+	return targetsNetworks, nil
+}
+
+// hasLabels tells if labels have any label with generator prefix
+func (g *CaddyfileGenerator) hasLabels(labels map[string]string) bool {
+	for label := range labels {
+		if g.labelRegex.MatchString(label) {
+			return true
+		}
+	}
+	return false
+}
+
+func sortNetworkRefs(networks []networkRef) []networkRef {
+	sort.Slice(networks, func(i, j int) bool {
+		if networks[i].name != networks[j].name {
+			return networks[i].name < networks[j].name
+		}
+		return networks[i].id < networks[j].id
+	})
+	return networks
+}
+
+func getSortedTargets(targetsNetworks map[string][]networkRef) []string {
+	targets := []string{}
+	for target := range targetsNetworks {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	return targets
+}
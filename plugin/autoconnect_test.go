@@ -0,0 +1,137 @@
+package plugin
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/network"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAutoConnect_ConnectsToAllowedNetwork(t *testing.T) {
+	dockerClient := createAutoConnectDockerClientMock()
+	generator := createAutoConnectGenerator(dockerClient, "team-*", false)
+
+	const expectedCaddyfile = "service.testdomain.com {\n" +
+		"  proxy / 10.2.0.2\n" +
+		"}\n"
+
+	const expectedLogs = skipCaddyfileText +
+		"[INFO] Connected caddy to network team-a_default of container team-a-web (CONTAINER-ID)\n"
+
+	caddyfileBytes, logs, err := generator.GenerateCaddyFile()
+	assert.NoError(t, err)
+	assert.Equal(t, expectedCaddyfile, string(caddyfileBytes))
+	assert.Equal(t, expectedLogs, logs)
+	assert.Equal(t, 1, dockerClient.CallCount("NetworkConnect"))
+
+	// caddy stays connected while network has targets
+	caddyfileBytes, logs, err = generator.GenerateCaddyFile()
+	assert.NoError(t, err)
+	assert.Equal(t, expectedCaddyfile, string(caddyfileBytes))
+	assert.Equal(t, skipCaddyfileText, logs)
+	assert.Equal(t, 1, dockerClient.CallCount("NetworkConnect"))
+}
+
+func TestAutoConnect_IgnoresNetworksNotAllowed(t *testing.T) {
+	dockerClient := createAutoConnectDockerClientMock()
+	generator := createAutoConnectGenerator(dockerClient, "other-*", false)
+
+	const expectedLogs = skipCaddyfileText +
+		"[ERROR] Container CONTAINER-ID and caddy are not in same network\n"
+
+	caddyfileBytes, logs, err := generator.GenerateCaddyFile()
+	assert.NoError(t, err)
+	assert.Equal(t, "", string(caddyfileBytes))
+	assert.Equal(t, expectedLogs, logs)
+	assert.Equal(t, 0, dockerClient.CallCount("NetworkConnect"))
+}
+
+func TestAutoConnect_DisconnectsNetworksWithoutTargets(t *testing.T) {
+	dockerClient := createAutoConnectDockerClientMock()
+	generator := createAutoConnectGenerator(dockerClient, "team-*", true)
+
+	_, _, err := generator.GenerateCaddyFile()
+	assert.NoError(t, err)
+
+	dockerClient.ContainersData = []types.Container{}
+
+	const expectedLogs = skipCaddyfileText +
+		"[INFO] Disconnected caddy from network team-a_default without targets\n"
+
+	caddyfileBytes, logs, err := generator.GenerateCaddyFile()
+	assert.NoError(t, err)
+	assert.Equal(t, "", string(caddyfileBytes))
+	assert.Equal(t, expectedLogs, logs)
+	assert.Equal(t, 1, dockerClient.CallCount("NetworkDisconnect"))
+	assert.Len(t, dockerClient.ContainerInspectData[caddyContainerID].NetworkSettings.Networks, 1)
+}
+
+func TestAutoConnect_RetriesFailedConnectsAfterEvents(t *testing.T) {
+	dockerClient := createAutoConnectDockerClientMock()
+	dockerClient.NetworkConnectError = fmt.Errorf("permission denied")
+	generator := createAutoConnectGenerator(dockerClient, "team-*", false)
+
+	const notSharedLog = "[ERROR] Container CONTAINER-ID and caddy are not in same network\n"
+	const expectedLogs = skipCaddyfileText +
+		"[ERROR] Failed to connect caddy to network team-a_default of container team-a-web (CONTAINER-ID), retrying after next container or network event: permission denied\n" +
+		notSharedLog
+
+	_, logs, err := generator.GenerateCaddyFile()
+	assert.NoError(t, err)
+	assert.Equal(t, expectedLogs, logs)
+	assert.Equal(t, 1, dockerClient.CallCount("NetworkConnect"))
+
+	// failed connect isn't tried again on every generation
+	_, logs, err = generator.GenerateCaddyFile()
+	assert.NoError(t, err)
+	assert.Equal(t, skipCaddyfileText+notSharedLog, logs)
+	assert.Equal(t, 1, dockerClient.CallCount("NetworkConnect"))
+
+	generator.forgetFailedConnects()
+	_, logs, err = generator.GenerateCaddyFile()
+	assert.NoError(t, err)
+	assert.Equal(t, expectedLogs, logs)
+	assert.Equal(t, 2, dockerClient.CallCount("NetworkConnect"))
+}
+
+func TestAutoConnect_ParsesNetworkPatterns(t *testing.T) {
+	assert.Equal(t, []string{"team-*", "frontend"}, parseNetworkPatterns(" team-*, frontend [invalid"))
+	assert.Equal(t, []string{}, parseNetworkPatterns(""))
+}
+
+func createAutoConnectDockerClientMock() *dockerClientMock {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.NetworkInspectData["team-a-network-id"] = types.NetworkResource{
+		ID:   "team-a-network-id",
+		Name: "team-a_default",
+	}
+	dockerClient.ContainersData = []types.Container{
+		types.Container{
+			ID:    "CONTAINER-ID",
+			Names: []string{"/team-a-web"},
+			NetworkSettings: &types.SummaryNetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"team-a_default": &network.EndpointSettings{
+						IPAddress: "10.2.0.2",
+						NetworkID: "team-a-network-id",
+					},
+				},
+			},
+			Labels: map[string]string{
+				fmtLabel("%s.address"): "service.testdomain.com",
+			},
+		},
+	}
+	return dockerClient
+}
+
+func createAutoConnectGenerator(dockerClient *dockerClientMock, connectNetworks string, disconnectNetworks bool) *CaddyfileGenerator {
+	return CreateGenerator(dockerClient, createDockerUtilsMock(), &GeneratorOptions{
+		labelPrefix:        defaultLabelPrefix,
+		validateNetwork:    true,
+		connectNetworks:    parseNetworkPatterns(connectNetworks),
+		disconnectNetworks: disconnectNetworks,
+	})
+}
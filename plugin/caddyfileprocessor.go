@@ -35,6 +35,7 @@ func ProcessCaddyfile(caddyfileContent []byte) []byte {
 			newCaddyfileBuffer.Write(serverBlockContent)
 		} else {
 			log.Printf("[WARN] Removing invalid server block: %s\n%s\n", err, serverBlockContent)
+			metricRemovedBlocks.add("", 1)
 		}
 	}
 	return newCaddyfileBuffer.Bytes()
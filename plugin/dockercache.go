@@ -0,0 +1,547 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/swarm"
+)
+
+// ignoredContainerActions are container events that don't change container listing
+var ignoredContainerActions = map[string]bool{
+	"attach":         true,
+	"commit":         true,
+	"copy":           true,
+	"export":         true,
+	"resize":         true,
+	"top":            true,
+	"archive-path":   true,
+	"extract-to-dir": true,
+}
+
+// dockerCache is a DockerClient serving reads from an in memory copy of docker state.
+// It is seeded by Resync and then patched from docker events, so generating a caddyfile
+// doesn't need to list every docker object again.
+type dockerCache struct {
+	client     DockerClient
+	mutex      sync.RWMutex
+	synced     bool
+	err        error
+	info       types.Info
+	containers map[string]types.Container
+	services   map[string]swarm.Service
+	tasks      map[string]swarm.Task
+	configs    map[string]swarm.Config
+	networks   map[string]types.NetworkResource
+}
+
+func newDockerCache(client DockerClient) *dockerCache {
+	return &dockerCache{
+		client:     client,
+		containers: map[string]types.Container{},
+		services:   map[string]swarm.Service{},
+		tasks:      map[string]swarm.Task{},
+		configs:    map[string]swarm.Config{},
+		networks:   map[string]types.NetworkResource{},
+	}
+}
+
+// Resync reloads all docker objects, logging objects the cache had missed
+func (cache *dockerCache) Resync(ctx context.Context) error {
+	info, err := cache.client.Info(ctx)
+	if err != nil {
+		cache.resyncFailed(err)
+		return err
+	}
+
+	var errs []string
+
+	containers, err := cache.listContainers(ctx, filters.NewArgs())
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	networks, err := cache.listNetworks(ctx, filters.NewArgs())
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	var services map[string]swarm.Service
+	var tasks map[string]swarm.Task
+	var configs map[string]swarm.Config
+
+	if info.Swarm.LocalNodeState == swarm.LocalNodeStateActive {
+		if services, err = cache.listServices(ctx, filters.NewArgs()); err != nil {
+			errs = append(errs, err.Error())
+		}
+		if tasks, err = cache.listTasks(ctx, filters.NewArgs()); err != nil {
+			errs = append(errs, err.Error())
+		}
+		if configs, err = cache.listConfigs(ctx); err != nil {
+			errs = append(errs, err.Error())
+		}
+	} else {
+		services = map[string]swarm.Service{}
+		tasks = map[string]swarm.Task{}
+		configs = map[string]swarm.Config{}
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	var outOfSync []string
+	if containers != nil {
+		if cache.synced && !reflect.DeepEqual(containersFingerprint(cache.containers), containersFingerprint(containers)) {
+			outOfSync = append(outOfSync, "containers")
+		}
+		cache.containers = containers
+	}
+	if networks != nil {
+		if cache.synced && !reflect.DeepEqual(networksFingerprint(cache.networks), networksFingerprint(networks)) {
+			outOfSync = append(outOfSync, "networks")
+		}
+		cache.networks = networks
+	}
+	if services != nil {
+		if cache.synced && !reflect.DeepEqual(servicesFingerprint(cache.services), servicesFingerprint(services)) {
+			outOfSync = append(outOfSync, "services")
+		}
+		cache.services = services
+	}
+	if tasks != nil {
+		if cache.synced && !reflect.DeepEqual(tasksFingerprint(cache.tasks), tasksFingerprint(tasks)) {
+			outOfSync = append(outOfSync, "tasks")
+		}
+		cache.tasks = tasks
+	}
+	if configs != nil {
+		if cache.synced && !reflect.DeepEqual(configsFingerprint(cache.configs), configsFingerprint(configs)) {
+			outOfSync = append(outOfSync, "configs")
+		}
+		cache.configs = configs
+	}
+	if len(outOfSync) > 0 {
+		log.Printf("[WARN] Docker state cache was out of sync: %v\n", strings.Join(outOfSync, ", "))
+	}
+
+	cache.info = info
+
+	if len(errs) > 0 {
+		err = fmt.Errorf("%v", strings.Join(errs, "; "))
+		if !cache.synced {
+			cache.err = err
+		}
+		return err
+	}
+
+	cache.synced = true
+	cache.err = nil
+	return nil
+}
+
+func (cache *dockerCache) resyncFailed(err error) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if !cache.synced {
+		cache.err = err
+	}
+}
+
+// HandleEvent patches cached state with the objects affected by a docker event
+func (cache *dockerCache) HandleEvent(ctx context.Context, event events.Message) error {
+	id := event.Actor.ID
+	if id == "" {
+		return nil
+	}
+
+	switch event.Type {
+	case "container":
+		if ignoredContainerActions[event.Action] || strings.HasPrefix(event.Action, "exec_") {
+			return nil
+		}
+		if err := cache.refreshContainer(ctx, id); err != nil {
+			return err
+		}
+		if serviceID := event.Actor.Attributes["com.docker.swarm.service.id"]; serviceID != "" {
+			return cache.refreshTasks(ctx, serviceID)
+		}
+	case "service":
+		if event.Action == "remove" {
+			// docker rejects task lists filtered by removed services
+			cache.removeService(id)
+			return nil
+		}
+		if err := cache.refreshService(ctx, id); err != nil {
+			return err
+		}
+		return cache.refreshTasks(ctx, id)
+	case "config":
+		return cache.refreshConfig(ctx, id, event.Action == "remove")
+	case "network":
+		if err := cache.refreshNetwork(ctx, id); err != nil {
+			return err
+		}
+		if containerID := event.Actor.Attributes["container"]; containerID != "" {
+			return cache.refreshContainer(ctx, containerID)
+		}
+	}
+	return nil
+}
+
+func (cache *dockerCache) refreshContainer(ctx context.Context, id string) error {
+	containers, err := cache.listContainers(ctx, filters.NewArgs(filters.Arg("id", id)))
+	if err != nil {
+		return err
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	delete(cache.containers, id)
+	if container, ok := containers[id]; ok {
+		cache.containers[id] = container
+	}
+	return nil
+}
+
+func (cache *dockerCache) refreshService(ctx context.Context, id string) error {
+	services, err := cache.listServices(ctx, filters.NewArgs(filters.Arg("id", id)))
+	if err != nil {
+		return err
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	delete(cache.services, id)
+	if service, ok := services[id]; ok {
+		cache.services[id] = service
+	}
+	return nil
+}
+
+func (cache *dockerCache) removeService(id string) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	delete(cache.services, id)
+	for taskID, task := range cache.tasks {
+		if task.ServiceID == id {
+			delete(cache.tasks, taskID)
+		}
+	}
+}
+
+func (cache *dockerCache) refreshTasks(ctx context.Context, serviceID string) error {
+	tasks, err := cache.listTasks(ctx, filters.NewArgs(filters.Arg("service", serviceID)))
+	if err != nil {
+		return err
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	for id, task := range cache.tasks {
+		if task.ServiceID == serviceID {
+			delete(cache.tasks, id)
+		}
+	}
+	for id, task := range tasks {
+		if task.ServiceID == serviceID {
+			cache.tasks[id] = task
+		}
+	}
+	return nil
+}
+
+func (cache *dockerCache) refreshConfig(ctx context.Context, id string, removed bool) error {
+	if removed {
+		cache.mutex.Lock()
+		defer cache.mutex.Unlock()
+		delete(cache.configs, id)
+		return nil
+	}
+	config, _, err := cache.client.ConfigInspectWithRaw(ctx, id)
+	if err != nil {
+		return err
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.configs[id] = config
+	return nil
+}
+
+func (cache *dockerCache) refreshNetwork(ctx context.Context, id string) error {
+	networks, err := cache.listNetworks(ctx, filters.NewArgs(filters.Arg("id", id)))
+	if err != nil {
+		return err
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	delete(cache.networks, id)
+	if network, ok := networks[id]; ok {
+		cache.networks[id] = network
+	}
+	return nil
+}
+
+func (cache *dockerCache) listContainers(ctx context.Context, args filters.Args) (map[string]types.Container, error) {
+	containers, err := cache.client.ContainerList(ctx, types.ContainerListOptions{Filters: args})
+	if err != nil {
+		return nil, err
+	}
+	result := map[string]types.Container{}
+	for _, container := range containers {
+		result[container.ID] = container
+	}
+	return result, nil
+}
+
+func (cache *dockerCache) listServices(ctx context.Context, args filters.Args) (map[string]swarm.Service, error) {
+	services, err := cache.client.ServiceList(ctx, types.ServiceListOptions{Filters: args})
+	if err != nil {
+		return nil, err
+	}
+	result := map[string]swarm.Service{}
+	for _, service := range services {
+		result[service.ID] = service
+	}
+	return result, nil
+}
+
+func (cache *dockerCache) listTasks(ctx context.Context, args filters.Args) (map[string]swarm.Task, error) {
+	args.Add("desired-state", "running")
+	tasks, err := cache.client.TaskList(ctx, types.TaskListOptions{Filters: args})
+	if err != nil {
+		return nil, err
+	}
+	result := map[string]swarm.Task{}
+	for _, task := range tasks {
+		result[task.ID] = task
+	}
+	return result, nil
+}
+
+// listConfigs lists configs, inspecting only the ones that changed since they were cached
+func (cache *dockerCache) listConfigs(ctx context.Context) (map[string]swarm.Config, error) {
+	configs, err := cache.client.ConfigList(ctx, types.ConfigListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	cache.mutex.RLock()
+	cached := cache.configs
+	cache.mutex.RUnlock()
+
+	result := map[string]swarm.Config{}
+	for _, config := range configs {
+		if cachedConfig, ok := cached[config.ID]; ok && cachedConfig.Version.Index == config.Version.Index {
+			result[config.ID] = cachedConfig
+			continue
+		}
+		fullConfig, _, err := cache.client.ConfigInspectWithRaw(ctx, config.ID)
+		if err != nil {
+			return nil, err
+		}
+		result[config.ID] = fullConfig
+	}
+	return result, nil
+}
+
+func (cache *dockerCache) listNetworks(ctx context.Context, args filters.Args) (map[string]types.NetworkResource, error) {
+	networks, err := cache.client.NetworkList(ctx, types.NetworkListOptions{Filters: args})
+	if err != nil {
+		return nil, err
+	}
+	result := map[string]types.NetworkResource{}
+	for _, network := range networks {
+		result[network.ID] = network
+	}
+	return result, nil
+}
+
+// ContainerList returns cached containers
+func (cache *dockerCache) ContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+	cache.mutex.RLock()
+	defer cache.mutex.RUnlock()
+	if cache.err != nil {
+		return nil, cache.err
+	}
+	containers := []types.Container{}
+	for _, container := range cache.containers {
+		containers = append(containers, container)
+	}
+	sort.Slice(containers, func(i, j int) bool { return containers[i].ID < containers[j].ID })
+	return containers, nil
+}
+
+// ServiceList returns cached services
+func (cache *dockerCache) ServiceList(ctx context.Context, options types.ServiceListOptions) ([]swarm.Service, error) {
+	cache.mutex.RLock()
+	defer cache.mutex.RUnlock()
+	if cache.err != nil {
+		return nil, cache.err
+	}
+	services := []swarm.Service{}
+	for _, service := range cache.services {
+		services = append(services, service)
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].ID < services[j].ID })
+	return services, nil
+}
+
+// TaskList returns cached tasks matching service and desired-state filters
+func (cache *dockerCache) TaskList(ctx context.Context, options types.TaskListOptions) ([]swarm.Task, error) {
+	cache.mutex.RLock()
+	defer cache.mutex.RUnlock()
+	if cache.err != nil {
+		return nil, cache.err
+	}
+	tasks := []swarm.Task{}
+	for _, task := range cache.tasks {
+		if !options.Filters.ExactMatch("service", task.ServiceID) {
+			continue
+		}
+		if !options.Filters.ExactMatch("desired-state", string(task.DesiredState)) {
+			continue
+		}
+		tasks = append(tasks, task)
+	}
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].ID < tasks[j].ID })
+	return tasks, nil
+}
+
+// Info returns cached docker info
+func (cache *dockerCache) Info(ctx context.Context) (types.Info, error) {
+	cache.mutex.RLock()
+	defer cache.mutex.RUnlock()
+	if cache.err != nil {
+		return types.Info{}, cache.err
+	}
+	return cache.info, nil
+}
+
+// ContainerInspect isn't cached
+func (cache *dockerCache) ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error) {
+	return cache.client.ContainerInspect(ctx, containerID)
+}
+
+// NetworkInspect returns cached network, falling back to docker when it isn't cached
+func (cache *dockerCache) NetworkInspect(ctx context.Context, networkID string, options types.NetworkInspectOptions) (types.NetworkResource, error) {
+	cache.mutex.RLock()
+	network, ok := cache.networks[networkID]
+	cache.mutex.RUnlock()
+	if ok {
+		return network, nil
+	}
+	return cache.client.NetworkInspect(ctx, networkID, options)
+}
+
+// NetworkList returns cached networks
+func (cache *dockerCache) NetworkList(ctx context.Context, options types.NetworkListOptions) ([]types.NetworkResource, error) {
+	cache.mutex.RLock()
+	defer cache.mutex.RUnlock()
+	if cache.err != nil {
+		return nil, cache.err
+	}
+	networks := []types.NetworkResource{}
+	for _, network := range cache.networks {
+		networks = append(networks, network)
+	}
+	sort.Slice(networks, func(i, j int) bool { return networks[i].ID < networks[j].ID })
+	return networks, nil
+}
+
+// NetworkConnect isn't cached, caddy container networks are refreshed from its network event
+func (cache *dockerCache) NetworkConnect(ctx context.Context, networkID, containerID string, config *network.EndpointSettings) error {
+	return cache.client.NetworkConnect(ctx, networkID, containerID, config)
+}
+
+// NetworkDisconnect isn't cached, caddy container networks are refreshed from its network event
+func (cache *dockerCache) NetworkDisconnect(ctx context.Context, networkID, containerID string, force bool) error {
+	return cache.client.NetworkDisconnect(ctx, networkID, containerID, force)
+}
+
+// ConfigList returns cached configs
+func (cache *dockerCache) ConfigList(ctx context.Context, options types.ConfigListOptions) ([]swarm.Config, error) {
+	cache.mutex.RLock()
+	defer cache.mutex.RUnlock()
+	if cache.err != nil {
+		return nil, cache.err
+	}
+	configs := []swarm.Config{}
+	for _, config := range cache.configs {
+		configs = append(configs, config)
+	}
+	sort.Slice(configs, func(i, j int) bool { return configs[i].ID < configs[j].ID })
+	return configs, nil
+}
+
+// ConfigInspectWithRaw returns cached config with its data
+func (cache *dockerCache) ConfigInspectWithRaw(ctx context.Context, id string) (swarm.Config, []byte, error) {
+	cache.mutex.RLock()
+	defer cache.mutex.RUnlock()
+	if config, ok := cache.configs[id]; ok {
+		return config, nil, nil
+	}
+	return swarm.Config{}, nil, fmt.Errorf("Config %v not found", id)
+}
+
+// Ping isn't cached
+func (cache *dockerCache) Ping(ctx context.Context) (types.Ping, error) {
+	return cache.client.Ping(ctx)
+}
+
+// Events isn't cached
+func (cache *dockerCache) Events(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error) {
+	return cache.client.Events(ctx, options)
+}
+
+func containersFingerprint(containers map[string]types.Container) map[string]string {
+	result := map[string]string{}
+	for id, container := range containers {
+		networks := []string{}
+		if container.NetworkSettings != nil {
+			for name, network := range container.NetworkSettings.Networks {
+				networks = append(networks, fmt.Sprintf("%v:%v:%v", name, network.NetworkID, network.IPAddress))
+			}
+		}
+		sort.Strings(networks)
+		result[id] = fmt.Sprintf("%v %v %v", container.State, container.Labels, networks)
+	}
+	return result
+}
+
+func servicesFingerprint(services map[string]swarm.Service) map[string]string {
+	result := map[string]string{}
+	for id, service := range services {
+		result[id] = fmt.Sprint(service.Version.Index)
+	}
+	return result
+}
+
+func tasksFingerprint(tasks map[string]swarm.Task) map[string]string {
+	result := map[string]string{}
+	for id, task := range tasks {
+		result[id] = string(task.Status.State)
+	}
+	return result
+}
+
+func configsFingerprint(configs map[string]swarm.Config) map[string]string {
+	result := map[string]string{}
+	for id, config := range configs {
+		result[id] = fmt.Sprint(config.Version.Index)
+	}
+	return result
+}
+
+func networksFingerprint(networks map[string]types.NetworkResource) map[string]string {
+	result := map[string]string{}
+	for id, network := range networks {
+		result[id] = network.Name
+	}
+	return result
+}
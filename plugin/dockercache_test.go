@@ -0,0 +1,201 @@
+package plugin
+
+import (
+	"context"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDockerCache_GeneratesWithoutListingDockerAgain(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ContainersData = []types.Container{
+		createTestContainer("container-id", "container.testdomain.com"),
+	}
+	dockerClient.ServicesData = []swarm.Service{
+		createTestService("service-id", "service.testdomain.com"),
+	}
+	dockerClient.ConfigsData = []swarm.Config{
+		swarm.Config{
+			ID: "config-id",
+			Spec: swarm.ConfigSpec{
+				Annotations: swarm.Annotations{
+					Labels: map[string]string{
+						fmtLabel("%s"): "",
+					},
+				},
+				Data: []byte("config.testdomain.com {\n}"),
+			},
+		},
+	}
+
+	cache := newDockerCache(dockerClient)
+	assert.NoError(t, cache.Resync(context.Background()))
+
+	generator := CreateGenerator(cache, createDockerUtilsMock(), &GeneratorOptions{
+		labelPrefix:       defaultLabelPrefix,
+		proxyServiceTasks: true,
+		validateNetwork:   true,
+	})
+
+	for i := 0; i < 3; i++ {
+		_, _, err := generator.GenerateCaddyFile()
+		assert.NoError(t, err)
+	}
+
+	assert.Equal(t, 1, dockerClient.CallCount("ContainerList"))
+	assert.Equal(t, 1, dockerClient.CallCount("ServiceList"))
+	assert.Equal(t, 1, dockerClient.CallCount("TaskList"))
+	assert.Equal(t, 1, dockerClient.CallCount("ConfigList"))
+	assert.Equal(t, 1, dockerClient.CallCount("ConfigInspectWithRaw"))
+}
+
+func TestDockerCache_ResyncOnlyInspectsChangedConfigs(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ConfigsData = []swarm.Config{
+		swarm.Config{ID: "config-a"},
+		swarm.Config{ID: "config-b"},
+	}
+
+	cache := newDockerCache(dockerClient)
+	assert.NoError(t, cache.Resync(context.Background()))
+	assert.Equal(t, 2, dockerClient.CallCount("ConfigInspectWithRaw"))
+
+	dockerClient.ConfigsData[1].Version.Index = 2
+	assert.NoError(t, cache.Resync(context.Background()))
+	assert.Equal(t, 3, dockerClient.CallCount("ConfigInspectWithRaw"))
+}
+
+func TestDockerCache_PatchesContainersFromEvents(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	cache := newDockerCache(dockerClient)
+	assert.NoError(t, cache.Resync(context.Background()))
+
+	dockerClient.ContainersData = []types.Container{
+		createTestContainer("container-id", "container.testdomain.com"),
+	}
+	assert.NoError(t, cache.HandleEvent(context.Background(), events.Message{
+		Type:   "container",
+		Action: "start",
+		Actor:  events.Actor{ID: "container-id"},
+	}))
+
+	containers, err := cache.ContainerList(context.Background(), types.ContainerListOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, containers, 1)
+
+	dockerClient.ContainersData = []types.Container{}
+	assert.NoError(t, cache.HandleEvent(context.Background(), events.Message{
+		Type:   "container",
+		Action: "die",
+		Actor:  events.Actor{ID: "container-id"},
+	}))
+
+	containers, err = cache.ContainerList(context.Background(), types.ContainerListOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, containers, 0)
+}
+
+func TestDockerCache_PatchesServicesAndTasksFromEvents(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	cache := newDockerCache(dockerClient)
+	assert.NoError(t, cache.Resync(context.Background()))
+
+	dockerClient.ServicesData = []swarm.Service{
+		createTestService("service-id", "service.testdomain.com"),
+	}
+	dockerClient.TasksData = []swarm.Task{
+		swarm.Task{
+			ID:           "task-id",
+			ServiceID:    "service-id",
+			DesiredState: swarm.TaskStateRunning,
+		},
+	}
+	assert.NoError(t, cache.HandleEvent(context.Background(), events.Message{
+		Type:   "service",
+		Action: "create",
+		Actor:  events.Actor{ID: "service-id"},
+	}))
+
+	services, err := cache.ServiceList(context.Background(), types.ServiceListOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, services, 1)
+
+	tasks, err := cache.TaskList(context.Background(), types.TaskListOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, tasks, 1)
+
+	dockerClient.ServicesData = []swarm.Service{}
+	dockerClient.TasksData = []swarm.Task{}
+	assert.NoError(t, cache.HandleEvent(context.Background(), events.Message{
+		Type:   "service",
+		Action: "remove",
+		Actor:  events.Actor{ID: "service-id"},
+	}))
+
+	services, err = cache.ServiceList(context.Background(), types.ServiceListOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, services, 0)
+
+	tasks, err = cache.TaskList(context.Background(), types.TaskListOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, tasks, 0)
+}
+
+func TestDockerCache_RemovesServicesWithoutListingDocker(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ServicesData = []swarm.Service{
+		createTestService("service-id", "service.testdomain.com"),
+	}
+	dockerClient.TasksData = []swarm.Task{
+		swarm.Task{
+			ID:           "task-id",
+			ServiceID:    "service-id",
+			DesiredState: swarm.TaskStateRunning,
+		},
+	}
+	cache := newDockerCache(dockerClient)
+	assert.NoError(t, cache.Resync(context.Background()))
+
+	assert.NoError(t, cache.HandleEvent(context.Background(), events.Message{
+		Type:   "service",
+		Action: "remove",
+		Actor:  events.Actor{ID: "service-id"},
+	}))
+
+	services, err := cache.ServiceList(context.Background(), types.ServiceListOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, services, 0)
+
+	tasks, err := cache.TaskList(context.Background(), types.TaskListOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, tasks, 0)
+
+	// docker rejects task lists filtered by removed services
+	assert.Equal(t, 1, dockerClient.CallCount("ServiceList"))
+	assert.Equal(t, 1, dockerClient.CallCount("TaskList"))
+}
+
+func createTestService(id string, address string) swarm.Service {
+	return swarm.Service{
+		ID: id,
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"): address,
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+}
@@ -2,8 +2,11 @@ package plugin
 
 import (
 	"context"
+	"time"
 
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/api/types/swarm"
 	"github.com/docker/docker/client"
 )
@@ -16,8 +19,13 @@ type DockerClient interface {
 	Info(ctx context.Context) (types.Info, error)
 	ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error)
 	NetworkInspect(ctx context.Context, networkID string, options types.NetworkInspectOptions) (types.NetworkResource, error)
+	NetworkList(ctx context.Context, options types.NetworkListOptions) ([]types.NetworkResource, error)
+	NetworkConnect(ctx context.Context, networkID, containerID string, config *network.EndpointSettings) error
+	NetworkDisconnect(ctx context.Context, networkID, containerID string, force bool) error
 	ConfigList(ctx context.Context, options types.ConfigListOptions) ([]swarm.Config, error)
 	ConfigInspectWithRaw(ctx context.Context, id string) (swarm.Config, []byte, error)
+	Ping(ctx context.Context) (types.Ping, error)
+	Events(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error)
 }
 
 // WrapDockerClient creates a new docker client wrapper
@@ -32,33 +40,90 @@ type dockerClientWrapper struct {
 }
 
 func (wrapper *dockerClientWrapper) ContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
-	return wrapper.client.ContainerList(ctx, options)
+	start := time.Now()
+	containers, err := wrapper.client.ContainerList(ctx, options)
+	observeDockerAPICall("ContainerList", start, err)
+	return containers, err
 }
 
 func (wrapper *dockerClientWrapper) ServiceList(ctx context.Context, options types.ServiceListOptions) ([]swarm.Service, error) {
-	return wrapper.client.ServiceList(ctx, options)
+	start := time.Now()
+	services, err := wrapper.client.ServiceList(ctx, options)
+	observeDockerAPICall("ServiceList", start, err)
+	return services, err
 }
 
 func (wrapper *dockerClientWrapper) TaskList(ctx context.Context, options types.TaskListOptions) ([]swarm.Task, error) {
-	return wrapper.client.TaskList(ctx, options)
+	start := time.Now()
+	tasks, err := wrapper.client.TaskList(ctx, options)
+	observeDockerAPICall("TaskList", start, err)
+	return tasks, err
 }
 
 func (wrapper *dockerClientWrapper) Info(ctx context.Context) (types.Info, error) {
-	return wrapper.client.Info(ctx)
+	start := time.Now()
+	info, err := wrapper.client.Info(ctx)
+	observeDockerAPICall("Info", start, err)
+	return info, err
 }
 
 func (wrapper *dockerClientWrapper) ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error) {
-	return wrapper.client.ContainerInspect(ctx, containerID)
+	start := time.Now()
+	container, err := wrapper.client.ContainerInspect(ctx, containerID)
+	observeDockerAPICall("ContainerInspect", start, err)
+	return container, err
 }
 
 func (wrapper *dockerClientWrapper) NetworkInspect(ctx context.Context, networkID string, options types.NetworkInspectOptions) (types.NetworkResource, error) {
-	return wrapper.client.NetworkInspect(ctx, networkID, options)
+	start := time.Now()
+	network, err := wrapper.client.NetworkInspect(ctx, networkID, options)
+	observeDockerAPICall("NetworkInspect", start, err)
+	return network, err
+}
+
+func (wrapper *dockerClientWrapper) NetworkList(ctx context.Context, options types.NetworkListOptions) ([]types.NetworkResource, error) {
+	start := time.Now()
+	networks, err := wrapper.client.NetworkList(ctx, options)
+	observeDockerAPICall("NetworkList", start, err)
+	return networks, err
+}
+
+func (wrapper *dockerClientWrapper) NetworkConnect(ctx context.Context, networkID, containerID string, config *network.EndpointSettings) error {
+	start := time.Now()
+	err := wrapper.client.NetworkConnect(ctx, networkID, containerID, config)
+	observeDockerAPICall("NetworkConnect", start, err)
+	return err
+}
+
+func (wrapper *dockerClientWrapper) NetworkDisconnect(ctx context.Context, networkID, containerID string, force bool) error {
+	start := time.Now()
+	err := wrapper.client.NetworkDisconnect(ctx, networkID, containerID, force)
+	observeDockerAPICall("NetworkDisconnect", start, err)
+	return err
 }
 
 func (wrapper *dockerClientWrapper) ConfigList(ctx context.Context, options types.ConfigListOptions) ([]swarm.Config, error) {
-	return wrapper.client.ConfigList(ctx, options)
+	start := time.Now()
+	configs, err := wrapper.client.ConfigList(ctx, options)
+	observeDockerAPICall("ConfigList", start, err)
+	return configs, err
 }
 
 func (wrapper *dockerClientWrapper) ConfigInspectWithRaw(ctx context.Context, id string) (swarm.Config, []byte, error) {
-	return wrapper.client.ConfigInspectWithRaw(ctx, id)
+	start := time.Now()
+	config, raw, err := wrapper.client.ConfigInspectWithRaw(ctx, id)
+	observeDockerAPICall("ConfigInspectWithRaw", start, err)
+	return config, raw, err
+}
+
+func (wrapper *dockerClientWrapper) Ping(ctx context.Context) (types.Ping, error) {
+	start := time.Now()
+	ping, err := wrapper.client.Ping(ctx)
+	observeDockerAPICall("Ping", start, err)
+	return ping, err
+}
+
+// Events isn't observed, as it is a stream
+func (wrapper *dockerClientWrapper) Events(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error) {
+	return wrapper.client.Events(ctx, options)
 }
@@ -1,11 +1,17 @@
 package plugin
 
 import (
-	"errors"
+	"context"
+	"fmt"
 	"io/ioutil"
+	"log"
 	"os"
 	"regexp"
 	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/docker/docker/api/types"
 )
 
 // DockerUtils is an interface with docker utilities
@@ -13,30 +19,173 @@ type DockerUtils interface {
 	GetCurrentContainerID() (string, error)
 }
 
-type dockerUtils struct{}
+// cgroupContainerIDRegex matches container IDs in cgroup paths, like
+// /docker/<id>, /system.slice/docker-<id>.scope, /libpod-<id>.scope/container or /cri-containerd-<id>.scope
+var cgroupContainerIDRegex = regexp.MustCompile("[/-]([0-9a-f]{64})(\\.scope)?(/|$)")
+
+// mountinfoContainerIDRegex matches container files mounted by docker and podman, like
+// /var/lib/docker/containers/<id>/hostname or /overlay-containers/<id>/userdata/resolv.conf
+var mountinfoContainerIDRegex = regexp.MustCompile("containers/([0-9a-f]{64})/(userdata/)?(hostname|hosts|resolv\\.conf)\\s")
+
+// containerIDDetector finds current container ID from one source
+type containerIDDetector struct {
+	name   string
+	detect func() (string, error)
+	// resolve tells if detected value can be a short ID or a name, resolved to the full ID with docker
+	resolve bool
+}
+
+type dockerUtils struct {
+	dockerClient DockerClient
+	goos         string
+	getenv       func(key string) string
+	readFile     func(path string) ([]byte, error)
+	hostname     func() (string, error)
+	mutex        sync.Mutex
+	containerID  string
+}
 
-// CreateDockerUtils creates a new instance of docker utils
-func CreateDockerUtils() DockerUtils {
-	return &dockerUtils{}
+// CreateDockerUtils creates a new instance of docker utils, using docker client to find current container by hostname
+func CreateDockerUtils(dockerClient DockerClient) DockerUtils {
+	return &dockerUtils{
+		dockerClient: dockerClient,
+		goos:         runtime.GOOS,
+		getenv:       os.Getenv,
+		readFile:     ioutil.ReadFile,
+		hostname:     os.Hostname,
+	}
 }
 
 // GetCurrentContainerID returns the id of the container running this application
 func (wrapper *dockerUtils) GetCurrentContainerID() (string, error) {
-	if runtime.GOOS == "windows" {
-		return os.Hostname()
+	wrapper.mutex.Lock()
+	defer wrapper.mutex.Unlock()
+
+	// current container doesn't change, but detection is retried until it succeeds
+	if wrapper.containerID != "" {
+		return wrapper.containerID, nil
+	}
+
+	failures := []string{}
+	for _, detector := range wrapper.getContainerIDDetectors() {
+		containerID, err := detector.detect()
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%v: %v", detector.name, err))
+			continue
+		}
+		if containerID == "" {
+			failures = append(failures, fmt.Sprintf("%v: not found", detector.name))
+			continue
+		}
+		if detector.resolve {
+			resolvedID, err := wrapper.resolveContainerID(containerID)
+			if err != nil {
+				// don't fall back to other sources, they would hide a wrong container ID
+				return "", fmt.Errorf("Cannot find container %v from %v: %v", containerID, detector.name, err)
+			}
+			containerID = resolvedID
+		}
+		log.Printf("[INFO] Caddy container ID %v detected from %v\n", containerID, detector.name)
+		wrapper.containerID = containerID
+		return containerID, nil
+	}
+	return "", fmt.Errorf("Cannot find container id (%v)", strings.Join(failures, "; "))
+}
+
+// getContainerIDDetectors returns container ID sources, in order of preference
+func (wrapper *dockerUtils) getContainerIDDetectors() []containerIDDetector {
+	detectors := []containerIDDetector{
+		{name: "CADDY_DOCKER_CONTAINER_ID", detect: wrapper.detectFromEnv, resolve: true},
+	}
+	if wrapper.goos == "windows" {
+		// windows containers hostname is the short container ID
+		return append(detectors, containerIDDetector{name: "hostname", detect: wrapper.hostname, resolve: true})
 	}
+	return append(detectors,
+		containerIDDetector{name: "/proc/self/cgroup", detect: wrapper.detectFromCgroup},
+		containerIDDetector{name: "/proc/self/mountinfo", detect: wrapper.detectFromMountinfo},
+		containerIDDetector{name: "hostname", detect: wrapper.detectFromHostname},
+	)
+}
 
-	bytes, err := ioutil.ReadFile("/proc/self/cgroup")
+func (wrapper *dockerUtils) detectFromEnv() (string, error) {
+	return strings.TrimSpace(wrapper.getenv("CADDY_DOCKER_CONTAINER_ID")), nil
+}
+
+// detectFromCgroup reads container ID from cgroup v1 paths, or cgroup v2 paths when cgroup namespace is shared with host
+func (wrapper *dockerUtils) detectFromCgroup() (string, error) {
+	content, err := wrapper.readFile("/proc/self/cgroup")
 	if err != nil {
 		return "", err
 	}
-	if len(bytes) > 0 {
-		cgroups := string(bytes)
-		idRegex := regexp.MustCompile("docker/([A-Za-z0-9]+)")
-		matches := idRegex.FindStringSubmatch(cgroups)
-		if len(matches) > 1 {
+	for _, line := range strings.Split(string(content), "\n") {
+		// lines are hierarchy-ID:controllers:path
+		parts := strings.SplitN(strings.TrimSpace(line), ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		// nested containers have many IDs, the last one is the innermost container
+		if matches := cgroupContainerIDRegex.FindAllStringSubmatch(parts[2], -1); matches != nil {
+			return matches[len(matches)-1][1], nil
+		}
+	}
+	return "", nil
+}
+
+// detectFromMountinfo reads container ID from the container files mounted over /etc
+func (wrapper *dockerUtils) detectFromMountinfo() (string, error) {
+	content, err := wrapper.readFile("/proc/self/mountinfo")
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		if matches := mountinfoContainerIDRegex.FindStringSubmatch(line); matches != nil {
 			return matches[1], nil
 		}
 	}
-	return "", errors.New("Cannot find container id")
+	return "", nil
+}
+
+// detectFromHostname finds the container whose ID starts with hostname, which is the default container hostname
+func (wrapper *dockerUtils) detectFromHostname() (string, error) {
+	if wrapper.dockerClient == nil {
+		return "", nil
+	}
+	hostname, err := wrapper.hostname()
+	if err != nil {
+		return "", err
+	}
+	if hostname == "" {
+		return "", nil
+	}
+	containers, err := wrapper.dockerClient.ContainerList(context.Background(), types.ContainerListOptions{})
+	if err != nil {
+		return "", err
+	}
+	containerID := ""
+	for _, container := range containers {
+		if strings.HasPrefix(container.ID, hostname) {
+			if containerID != "" {
+				return "", fmt.Errorf("Many containers match hostname %v", hostname)
+			}
+			containerID = container.ID
+		}
+	}
+	return containerID, nil
+}
+
+// resolveContainerID returns the full ID of a container from a short ID or a name,
+// networks events and containers lists only have full IDs
+func (wrapper *dockerUtils) resolveContainerID(containerID string) (string, error) {
+	if wrapper.dockerClient == nil {
+		return containerID, nil
+	}
+	container, err := wrapper.dockerClient.ContainerInspect(context.Background(), containerID)
+	if err != nil {
+		return "", err
+	}
+	if container.ContainerJSONBase == nil || container.ID == "" {
+		return "", fmt.Errorf("No such container")
+	}
+	return container.ID, nil
 }
@@ -0,0 +1,164 @@
+package plugin
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/stretchr/testify/assert"
+)
+
+const testContainerID = "3f4b5c6d7e8f90a1b2c3d4e5f60718293a4b5c6d7e8f90a1b2c3d4e5f6071829"
+
+const cgroupV1Docker = `12:memory:/docker/` + testContainerID + `
+11:cpu,cpuacct:/docker/` + testContainerID + `
+1:name=systemd:/docker/` + testContainerID + `
+0::/system.slice/containerd.service
+`
+
+const cgroupV1Systemd = `11:memory:/system.slice/docker-` + testContainerID + `.scope
+1:name=systemd:/system.slice/docker-` + testContainerID + `.scope
+`
+
+const cgroupV2Podman = `0::/machine.slice/libpod-` + testContainerID + `.scope/container
+`
+
+const cgroupV2Libpod = `0::/user.slice/user-1000.slice/user@1000.service/user.slice/libpod-` + testContainerID + `.scope
+`
+
+const cgroupV1Kubernetes = `12:pids:/kubepods/besteffort/pod6a1b2c3d-0000-4e5f-8a9b-0c1d2e3f4a5b/` + testContainerID + `
+`
+
+const cgroupV2Containerd = `0::/system.slice/cri-containerd-` + testContainerID + `.scope
+`
+
+const cgroupV2Namespaced = `0::/
+`
+
+const mountinfoDocker = `733 731 0:56 / / rw,relatime master:305 - overlay overlay rw,lowerdir=/var/lib/docker/overlay2/l/ABC:/var/lib/docker/overlay2/l/DEF
+790 733 254:1 /var/lib/docker/containers/` + testContainerID + `/resolv.conf /etc/resolv.conf rw,relatime - ext4 /dev/vda1 rw
+791 733 254:1 /var/lib/docker/containers/` + testContainerID + `/hostname /etc/hostname rw,relatime - ext4 /dev/vda1 rw
+792 733 254:1 /var/lib/docker/containers/` + testContainerID + `/hosts /etc/hosts rw,relatime - ext4 /dev/vda1 rw
+`
+
+const mountinfoPodman = `1225 1190 0:99 / / rw,relatime - overlay overlay rw
+1240 1225 0:25 /containers/storage/overlay-containers/` + testContainerID + `/userdata/hostname /etc/hostname rw,nosuid,nodev - tmpfs tmpfs rw
+`
+
+const mountinfoUnknown = `733 731 0:56 / / rw,relatime - overlay overlay rw
+790 733 254:1 /etc/resolv.conf /etc/resolv.conf rw,relatime - ext4 /dev/vda1 rw
+`
+
+func TestDockerUtils_DetectsContainerID(t *testing.T) {
+	tests := []struct {
+		name       string
+		env        string
+		cgroup     string
+		mountinfo  string
+		hostname   string
+		containers []string
+	}{
+		{name: "env override", env: testContainerID, cgroup: cgroupV2Namespaced, containers: []string{testContainerID}},
+		{name: "env override short id", env: testContainerID[:12], cgroup: cgroupV2Namespaced, containers: []string{testContainerID}},
+		{name: "cgroup v1", cgroup: cgroupV1Docker},
+		{name: "cgroup v1 systemd driver", cgroup: cgroupV1Systemd},
+		{name: "cgroup v2 podman", cgroup: cgroupV2Podman},
+		{name: "cgroup v2 rootless podman", cgroup: cgroupV2Libpod},
+		{name: "cgroup v1 kubernetes", cgroup: cgroupV1Kubernetes},
+		{name: "cgroup v2 containerd", cgroup: cgroupV2Containerd},
+		{name: "mountinfo docker", cgroup: cgroupV2Namespaced, mountinfo: mountinfoDocker},
+		{name: "mountinfo podman", cgroup: cgroupV2Namespaced, mountinfo: mountinfoPodman},
+		{
+			name:       "hostname",
+			cgroup:     cgroupV2Namespaced,
+			mountinfo:  mountinfoUnknown,
+			hostname:   testContainerID[:12],
+			containers: []string{"0123456789ab" + testContainerID[12:], testContainerID},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			utils := createTestDockerUtils(test.env, test.cgroup, test.mountinfo, test.hostname, test.containers)
+			containerID, err := utils.GetCurrentContainerID()
+			assert.NoError(t, err)
+			assert.Equal(t, testContainerID, containerID)
+		})
+	}
+}
+
+func TestDockerUtils_ReportsEachSourceWhenNotFound(t *testing.T) {
+	utils := createTestDockerUtils("", cgroupV2Namespaced, "", "custom-hostname", []string{testContainerID})
+
+	_, err := utils.GetCurrentContainerID()
+
+	assert.EqualError(t, err, "Cannot find container id ("+
+		"CADDY_DOCKER_CONTAINER_ID: not found; "+
+		"/proc/self/cgroup: not found; "+
+		"/proc/self/mountinfo: open /proc/self/mountinfo: file does not exist; "+
+		"hostname: not found)")
+}
+
+func TestDockerUtils_RejectsAmbiguousHostname(t *testing.T) {
+	utils := createTestDockerUtils("", cgroupV2Namespaced, mountinfoUnknown, "3f4b", []string{testContainerID, "3f4b" + testContainerID[4:63] + "0"})
+
+	_, err := utils.GetCurrentContainerID()
+
+	assert.Contains(t, err.Error(), "hostname: Many containers match hostname 3f4b")
+}
+
+func TestDockerUtils_RejectsUnknownEnvContainer(t *testing.T) {
+	utils := createTestDockerUtils("caddy", cgroupV1Docker, "", "", []string{testContainerID})
+
+	_, err := utils.GetCurrentContainerID()
+
+	assert.EqualError(t, err, "Cannot find container caddy from CADDY_DOCKER_CONTAINER_ID: No such container")
+}
+
+func TestDockerUtils_WindowsUsesHostname(t *testing.T) {
+	utils := createTestDockerUtils("", "", "", testContainerID[:12], []string{testContainerID})
+	utils.goos = "windows"
+
+	containerID, err := utils.GetCurrentContainerID()
+
+	assert.NoError(t, err)
+	assert.Equal(t, testContainerID, containerID)
+}
+
+func createTestDockerUtils(env string, cgroup string, mountinfo string, hostname string, containerIDs []string) *dockerUtils {
+	dockerClient := createBasicDockerClientMock()
+	for _, id := range containerIDs {
+		dockerClient.ContainersData = append(dockerClient.ContainersData, types.Container{ID: id})
+		// docker inspects containers by full or short ID
+		inspectData := types.ContainerJSON{ContainerJSONBase: &types.ContainerJSONBase{ID: id}}
+		dockerClient.ContainerInspectData[id] = inspectData
+		dockerClient.ContainerInspectData[id[:12]] = inspectData
+	}
+	files := map[string]string{
+		"/proc/self/cgroup":    cgroup,
+		"/proc/self/mountinfo": mountinfo,
+	}
+	return &dockerUtils{
+		dockerClient: dockerClient,
+		goos:         "linux",
+		getenv: func(key string) string {
+			if key == "CADDY_DOCKER_CONTAINER_ID" {
+				return env
+			}
+			return ""
+		},
+		readFile: func(path string) ([]byte, error) {
+			if content := files[path]; content != "" {
+				return []byte(content), nil
+			}
+			return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+		},
+		hostname: func() (string, error) {
+			if hostname == "" {
+				return "", fmt.Errorf("no hostname")
+			}
+			return hostname, nil
+		},
+	}
+}
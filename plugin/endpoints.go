@@ -0,0 +1,173 @@
+package plugin
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/docker/docker/client"
+)
+
+const (
+	// targetAddressNetwork proxies to container and service addresses on caddy networks
+	targetAddressNetwork = "network"
+	// targetAddressPublished proxies to ports published on docker host
+	targetAddressPublished = "published"
+)
+
+var endpointsFileFlag string
+var snapshotFileFlag string
+
+func init() {
+	flag.StringVar(&endpointsFileFlag, "docker-endpoints-file", "", "Path to a JSON file listing docker hosts to generate caddyfile from")
+	flag.StringVar(&snapshotFileFlag, "docker-snapshot-file", "", "Path to a docker snapshot to generate caddyfile from, instead of connecting to docker")
+}
+
+// DockerEndpoint configures a docker host caddyfile is generated from
+type DockerEndpoint struct {
+	// Name identifies the host in logs and generated routes
+	Name string `json:"name"`
+	// Host is the docker daemon address, like tcp://10.0.0.2:2376
+	Host string `json:"host"`
+	// APIVersion pins docker API version, negotiated when empty
+	APIVersion string `json:"apiVersion"`
+	// TLSCACert, TLSCert and TLSKey are paths to TLS material used to connect to Host
+	TLSCACert string `json:"tlsCACert"`
+	TLSCert   string `json:"tlsCert"`
+	TLSKey    string `json:"tlsKey"`
+	// LabelPrefix overrides the global label prefix for this host
+	LabelPrefix string `json:"labelPrefix"`
+	// TargetAddress is either network or published
+	TargetAddress string `json:"targetAddress"`
+	// PublishedAddress is the address used to reach published ports, defaults to Host hostname
+	PublishedAddress string `json:"publishedAddress"`
+	// ValidateNetwork overrides the global network validation for this host
+	ValidateNetwork *bool `json:"validateNetwork"`
+	// Snapshot is the path of a docker snapshot replayed instead of connecting to Host
+	Snapshot string `json:"snapshot"`
+}
+
+// dockerEndpoint is a connected docker host with its own state cache, events monitor and generator
+type dockerEndpoint struct {
+	name          string
+	client        DockerClient
+	cache         *dockerCache
+	eventsMonitor *eventsMonitor
+	generator     *CaddyfileGenerator
+}
+
+// GetDockerEndpoints reads docker endpoints from the file set by cli flag or environment variable.
+// It returns a single endpoint configured from docker environment variables when no file is set.
+func GetDockerEndpoints() ([]DockerEndpoint, error) {
+	endpointsFile := endpointsFileFlag
+	if endpointsFileEnv := os.Getenv("CADDY_DOCKER_ENDPOINTS_FILE"); endpointsFileEnv != "" {
+		endpointsFile = endpointsFileEnv
+	}
+
+	if endpointsFile == "" {
+		snapshotFile := snapshotFileFlag
+		if snapshotFileEnv := os.Getenv("CADDY_DOCKER_SNAPSHOT_FILE"); snapshotFileEnv != "" {
+			snapshotFile = snapshotFileEnv
+		}
+		return []DockerEndpoint{DockerEndpoint{Snapshot: snapshotFile}}, nil
+	}
+
+	content, err := ioutil.ReadFile(endpointsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseDockerEndpoints(content)
+}
+
+func parseDockerEndpoints(content []byte) ([]DockerEndpoint, error) {
+	var endpoints []DockerEndpoint
+	if err := json.Unmarshal(content, &endpoints); err != nil {
+		return nil, fmt.Errorf("Invalid docker endpoints file: %v", err)
+	}
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("Docker endpoints file doesn't have any endpoint")
+	}
+
+	names := map[string]bool{}
+	for i := range endpoints {
+		endpoint := &endpoints[i]
+		if endpoint.Name == "" {
+			endpoint.Name = endpoint.Host
+		}
+		if endpoint.Name == "" {
+			endpoint.Name = endpoint.Snapshot
+		}
+		if endpoint.Name == "" {
+			return nil, fmt.Errorf("Docker endpoint %v doesn't have name, host or snapshot", i)
+		}
+		if names[endpoint.Name] {
+			return nil, fmt.Errorf("Docker endpoint %v is duplicated", endpoint.Name)
+		}
+		names[endpoint.Name] = true
+
+		switch endpoint.TargetAddress {
+		case "":
+			endpoint.TargetAddress = targetAddressNetwork
+		case targetAddressNetwork, targetAddressPublished:
+		default:
+			return nil, fmt.Errorf("Docker endpoint %v has invalid target address %v", endpoint.Name, endpoint.TargetAddress)
+		}
+
+		if endpoint.TargetAddress == targetAddressPublished && endpoint.PublishedAddress == "" {
+			hostURL, err := client.ParseHostURL(endpoint.Host)
+			if err != nil || hostURL.Scheme != "tcp" {
+				return nil, fmt.Errorf("Docker endpoint %v requires publishedAddress", endpoint.Name)
+			}
+			endpoint.PublishedAddress = hostURL.Hostname()
+		}
+	}
+
+	return endpoints, nil
+}
+
+// createDockerClient creates a client for endpoint docker host, or for docker environment variables host when endpoint has no host.
+// API version is negotiated on first request unless endpoint pins it.
+func createDockerClient(endpoint DockerEndpoint) (*client.Client, error) {
+	opts := []client.Opt{}
+	if endpoint.Host == "" {
+		opts = append(opts, client.FromEnv)
+	} else {
+		opts = append(opts, client.WithHost(endpoint.Host))
+		if endpoint.TLSCACert != "" || endpoint.TLSCert != "" || endpoint.TLSKey != "" {
+			opts = append(opts, client.WithTLSClientConfig(endpoint.TLSCACert, endpoint.TLSCert, endpoint.TLSKey))
+		}
+	}
+	if endpoint.APIVersion != "" {
+		opts = append(opts, client.WithVersion(endpoint.APIVersion))
+	} else {
+		opts = append(opts, client.WithAPIVersionNegotiation())
+	}
+
+	return client.NewClientWithOpts(opts...)
+}
+
+// endpointGeneratorOptions applies endpoint overrides to global generator options
+func endpointGeneratorOptions(endpoint DockerEndpoint, options *GeneratorOptions) *GeneratorOptions {
+	endpointOptions := *options
+	endpointOptions.hostName = endpoint.Name
+	endpointOptions.targetAddress = endpoint.TargetAddress
+	endpointOptions.publishedAddress = endpoint.PublishedAddress
+	if endpoint.LabelPrefix != "" {
+		endpointOptions.labelPrefix = endpoint.LabelPrefix
+	}
+	if endpoint.ValidateNetwork != nil {
+		endpointOptions.validateNetwork = *endpoint.ValidateNetwork
+	}
+	return &endpointOptions
+}
+
+// logSuffix identifies the docker host in log messages when there are many
+func (endpoint *dockerEndpoint) logSuffix() string {
+	if endpoint == nil || endpoint.name == "" {
+		return ""
+	}
+	return " on " + endpoint.name
+}
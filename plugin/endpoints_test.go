@@ -0,0 +1,38 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEndpoints_ParseDefaults(t *testing.T) {
+	endpoints, err := parseDockerEndpoints([]byte(`[
+		{"host": "tcp://10.0.0.2:2376", "targetAddress": "published"},
+		{"name": "local", "host": "unix:///var/run/docker.sock", "labelPrefix": "proxy"}
+	]`))
+	assert.NoError(t, err)
+	assert.Len(t, endpoints, 2)
+
+	assert.Equal(t, "tcp://10.0.0.2:2376", endpoints[0].Name)
+	assert.Equal(t, targetAddressPublished, endpoints[0].TargetAddress)
+	assert.Equal(t, "10.0.0.2", endpoints[0].PublishedAddress)
+
+	assert.Equal(t, "local", endpoints[1].Name)
+	assert.Equal(t, targetAddressNetwork, endpoints[1].TargetAddress)
+	assert.Equal(t, "proxy", endpointGeneratorOptions(endpoints[1], &GeneratorOptions{labelPrefix: defaultLabelPrefix}).labelPrefix)
+}
+
+func TestEndpoints_ParseErrors(t *testing.T) {
+	_, err := parseDockerEndpoints([]byte(`[]`))
+	assert.Error(t, err)
+
+	_, err = parseDockerEndpoints([]byte(`[{"name": "a", "host": "tcp://a:2376"}, {"name": "a", "host": "tcp://b:2376"}]`))
+	assert.Error(t, err)
+
+	_, err = parseDockerEndpoints([]byte(`[{"host": "tcp://a:2376", "targetAddress": "bridge"}]`))
+	assert.Error(t, err)
+
+	_, err = parseDockerEndpoints([]byte(`[{"host": "unix:///var/run/docker.sock", "targetAddress": "published"}]`))
+	assert.Error(t, err)
+}
@@ -0,0 +1,153 @@
+package plugin
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/docker/docker/api/types/events"
+)
+
+// defaultUpdateEvents are the docker events that trigger caddyfile regeneration by default
+var defaultUpdateEvents = []string{
+	"container:create",
+	"container:start",
+	"container:stop",
+	"container:die",
+	"container:destroy",
+	"container:health_status*",
+	"service:create",
+	"service:update",
+	"service:remove",
+	"config:create",
+	"config:remove",
+}
+
+var eventPatternsSeparator = regexp.MustCompile("[\\s,]+")
+
+// dockerEventTypes are the types of events reported by docker
+var dockerEventTypes = []string{"config", "container", "daemon", "image", "network", "node", "plugin", "secret", "service", "volume"}
+
+// cachedEventTypes are the types of events docker state cache is patched from, always watched
+var cachedEventTypes = []string{"service", "container", "config", "network"}
+
+// eventMatcher matches docker events against type:action patterns
+type eventMatcher struct {
+	include []eventPattern
+	exclude []eventPattern
+}
+
+type eventPattern struct {
+	eventType string
+	action    string
+}
+
+func (pattern eventPattern) match(event events.Message) bool {
+	typeMatches, _ := path.Match(pattern.eventType, event.Type)
+	actionMatches, _ := path.Match(pattern.action, event.Action)
+	return typeMatches && actionMatches
+}
+
+func (pattern eventPattern) String() string {
+	return pattern.eventType + ":" + pattern.action
+}
+
+// parseEventMatcher parses a list of type:action patterns separated by spaces or commas.
+// Patterns support * wildcards, patterns prefixed with ! exclude events,
+// and the word default expands to the default events list.
+func parseEventMatcher(text string) (*eventMatcher, error) {
+	matcher := &eventMatcher{}
+
+	for _, item := range eventPatternsSeparator.Split(strings.TrimSpace(text), -1) {
+		if item == "" {
+			continue
+		}
+		if item == "default" {
+			for _, defaultItem := range defaultUpdateEvents {
+				pattern, _ := parseEventPattern(defaultItem)
+				matcher.include = append(matcher.include, pattern)
+			}
+			continue
+		}
+
+		exclude := strings.HasPrefix(item, "!")
+		pattern, err := parseEventPattern(strings.TrimPrefix(item, "!"))
+		if err != nil {
+			return nil, err
+		}
+		if exclude {
+			matcher.exclude = append(matcher.exclude, pattern)
+		} else {
+			matcher.include = append(matcher.include, pattern)
+		}
+	}
+
+	return matcher, nil
+}
+
+func parseEventPattern(text string) (eventPattern, error) {
+	parts := strings.SplitN(text, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return eventPattern{}, fmt.Errorf("Invalid event pattern %q, expected type:action", text)
+	}
+	pattern := eventPattern{
+		eventType: parts[0],
+		action:    parts[1],
+	}
+	for _, p := range parts {
+		if _, err := path.Match(p, ""); err != nil {
+			return eventPattern{}, fmt.Errorf("Invalid event pattern %q: %v", text, err)
+		}
+	}
+	if len(matchEventTypes(pattern.eventType)) == 0 {
+		return eventPattern{}, fmt.Errorf("Invalid event pattern %q, unknown docker event type %v", text, pattern.eventType)
+	}
+	return pattern, nil
+}
+
+// matchEventTypes returns the docker event types matching a type pattern
+func matchEventTypes(typePattern string) []string {
+	types := []string{}
+	for _, eventType := range dockerEventTypes {
+		if matches, _ := path.Match(typePattern, eventType); matches {
+			types = append(types, eventType)
+		}
+	}
+	return types
+}
+
+// EventTypes returns the docker event types matcher can include, to request only those from docker
+func (matcher *eventMatcher) EventTypes() []string {
+	types := []string{}
+	for _, pattern := range matcher.include {
+		types = appendUnique(types, matchEventTypes(pattern.eventType)...)
+	}
+	return types
+}
+
+// Match returns true when event matches any included pattern and no excluded pattern
+func (matcher *eventMatcher) Match(event events.Message) bool {
+	for _, pattern := range matcher.exclude {
+		if pattern.match(event) {
+			return false
+		}
+	}
+	for _, pattern := range matcher.include {
+		if pattern.match(event) {
+			return true
+		}
+	}
+	return false
+}
+
+func (matcher *eventMatcher) String() string {
+	var items []string
+	for _, pattern := range matcher.include {
+		items = append(items, pattern.String())
+	}
+	for _, pattern := range matcher.exclude {
+		items = append(items, "!"+pattern.String())
+	}
+	return strings.Join(items, " ")
+}
@@ -0,0 +1,57 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/docker/docker/api/types/events"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventMatcher_Default(t *testing.T) {
+	matcher, err := parseEventMatcher("default")
+	assert.NoError(t, err)
+
+	assert.True(t, matcher.Match(events.Message{Type: "container", Action: "start"}))
+	assert.True(t, matcher.Match(events.Message{Type: "service", Action: "update"}))
+	assert.False(t, matcher.Match(events.Message{Type: "container", Action: "exec_start: sh"}))
+	assert.False(t, matcher.Match(events.Message{Type: "network", Action: "connect"}))
+}
+
+func TestEventMatcher_ExtendsDefaultWithWildcards(t *testing.T) {
+	matcher, err := parseEventMatcher("default, container:health_status* network:connect network:disconnect")
+	assert.NoError(t, err)
+
+	assert.True(t, matcher.Match(events.Message{Type: "container", Action: "start"}))
+	assert.True(t, matcher.Match(events.Message{Type: "container", Action: "health_status: healthy"}))
+	assert.True(t, matcher.Match(events.Message{Type: "network", Action: "disconnect"}))
+	assert.False(t, matcher.Match(events.Message{Type: "network", Action: "create"}))
+}
+
+func TestEventMatcher_Excludes(t *testing.T) {
+	matcher, err := parseEventMatcher("container:* !container:exec_*")
+	assert.NoError(t, err)
+
+	assert.True(t, matcher.Match(events.Message{Type: "container", Action: "kill"}))
+	assert.False(t, matcher.Match(events.Message{Type: "container", Action: "exec_create: sh"}))
+	assert.Equal(t, "container:* !container:exec_*", matcher.String())
+}
+
+func TestEventMatcher_InvalidPatterns(t *testing.T) {
+	_, err := parseEventMatcher("container")
+	assert.Error(t, err)
+
+	_, err = parseEventMatcher("container:[")
+	assert.Error(t, err)
+
+	_, err = parseEventMatcher("default volumes:create")
+	assert.EqualError(t, err, "Invalid event pattern \"volumes:create\", unknown docker event type volumes")
+}
+
+func TestEventMatcher_RequestsConfiguredEventTypes(t *testing.T) {
+	matcher, err := parseEventMatcher("default node:update v*:* !secret:*")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"container", "service", "config", "node", "volume"}, matcher.EventTypes())
+
+	filters := createEventsFilters(matcher)
+	assert.ElementsMatch(t, []string{"service", "container", "config", "network", "node", "volume"}, filters.Get("type"))
+}
@@ -0,0 +1,190 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+)
+
+var eventsReconnectMinDelay = 1 * time.Second
+var eventsReconnectMaxDelay = 1 * time.Minute
+
+// EventsState is the connection state of docker events stream
+type EventsState int
+
+const (
+	// EventsDisconnected means events stream is down and waiting to reconnect
+	EventsDisconnected EventsState = iota
+	// EventsConnecting means events stream is being established
+	EventsConnecting
+	// EventsConnected means events are being received
+	EventsConnected
+)
+
+func (state EventsState) String() string {
+	switch state {
+	case EventsConnecting:
+		return "connecting"
+	case EventsConnected:
+		return "connected"
+	default:
+		return "disconnected"
+	}
+}
+
+// MarshalText encodes state as its name
+func (state EventsState) MarshalText() ([]byte, error) {
+	return []byte(state.String()), nil
+}
+
+// EventsStatus reports the current state of docker events stream
+type EventsStatus struct {
+	State      EventsState `json:"state"`
+	Since      time.Time   `json:"since"`
+	LastError  string      `json:"lastError,omitempty"`
+	Reconnects int         `json:"reconnects"`
+}
+
+// eventsMonitor keeps docker events stream connected, reconnecting with exponential backoff
+type eventsMonitor struct {
+	dockerClient DockerClient
+	filters      filters.Args
+	minDelay     time.Duration
+	maxDelay     time.Duration
+	onEvent      func(event events.Message)
+	onReconnect  func()
+	mutex        sync.Mutex
+	status       EventsStatus
+}
+
+func newEventsMonitor(dockerClient DockerClient, filters filters.Args, onEvent func(events.Message), onReconnect func()) *eventsMonitor {
+	return &eventsMonitor{
+		dockerClient: dockerClient,
+		filters:      filters,
+		minDelay:     eventsReconnectMinDelay,
+		maxDelay:     eventsReconnectMaxDelay,
+		onEvent:      onEvent,
+		onReconnect:  onReconnect,
+		status: EventsStatus{
+			State: EventsDisconnected,
+			Since: time.Now(),
+		},
+	}
+}
+
+// Status returns a snapshot of events stream status
+func (monitor *eventsMonitor) Status() EventsStatus {
+	monitor.mutex.Lock()
+	defer monitor.mutex.Unlock()
+	return monitor.status
+}
+
+func (monitor *eventsMonitor) setState(state EventsState, err error) {
+	monitor.mutex.Lock()
+	defer monitor.mutex.Unlock()
+	if state != monitor.status.State {
+		monitor.status.Since = time.Now()
+	}
+	monitor.status.State = state
+	if err != nil {
+		monitor.status.LastError = err.Error()
+	}
+}
+
+// run watches docker events until ctx is cancelled
+func (monitor *eventsMonitor) run(ctx context.Context) {
+	failures := 0
+	// docker state may have changed while disconnected, even when the first connection failed
+	retrying := false
+
+	for {
+		monitor.setState(EventsConnecting, nil)
+
+		started := time.Now()
+		err := monitor.watch(ctx, func() {
+			if retrying {
+				monitor.mutex.Lock()
+				monitor.status.Reconnects++
+				monitor.mutex.Unlock()
+				log.Printf("[INFO] Docker events stream reconnected\n")
+				monitor.onReconnect()
+			}
+			monitor.setState(EventsConnected, nil)
+		})
+
+		if ctx.Err() != nil {
+			monitor.setState(EventsDisconnected, nil)
+			return
+		}
+
+		// a connection that was stable for a while resets the backoff
+		if time.Since(started) > monitor.maxDelay {
+			failures = 0
+		}
+		failures++
+		retrying = true
+
+		delay := backoffDelay(failures, monitor.minDelay, monitor.maxDelay)
+		log.Printf("[ERROR] Docker events stream failed, reconnecting in %v: %v\n", delay, err)
+		monitor.setState(EventsDisconnected, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (monitor *eventsMonitor) watch(ctx context.Context, onConnected func()) error {
+	if _, err := monitor.dockerClient.Ping(ctx); err != nil {
+		return err
+	}
+
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	eventsChan, errorChan := monitor.dockerClient.Events(watchCtx, types.EventsOptions{
+		Filters: monitor.filters,
+	})
+
+	onConnected()
+
+	for {
+		select {
+		case event, ok := <-eventsChan:
+			if !ok {
+				return errors.New("events stream closed")
+			}
+			monitor.onEvent(event)
+		case err := <-errorChan:
+			if err == nil {
+				// docker client event error, is the docker socket no longer accessible?
+				err = errors.New("events stream closed")
+			}
+			return err
+		}
+	}
+}
+
+// backoffDelay returns an exponential delay with jitter for the given number of failures
+func backoffDelay(failures int, minDelay time.Duration, maxDelay time.Duration) time.Duration {
+	delay := minDelay
+	for i := 1; i < failures && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	if half := int64(delay / 2); half > 0 {
+		delay = time.Duration(half + rand.Int63n(half+1))
+	}
+	return delay
+}
@@ -0,0 +1,131 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventsMonitor_ReconnectsAfterStreamFailure(t *testing.T) {
+	var mutex sync.Mutex
+	connections := 0
+
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.MockEvents = func(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error) {
+		eventsChan := make(chan events.Message, 1)
+		errorChan := make(chan error, 1)
+		mutex.Lock()
+		connections++
+		if connections == 1 {
+			// first stream dies the same way it does when docker daemon restarts
+			errorChan <- nil
+		} else {
+			eventsChan <- events.Message{Type: "container", Action: "start"}
+		}
+		mutex.Unlock()
+		return eventsChan, errorChan
+	}
+
+	received := make(chan events.Message, 1)
+	reconnected := make(chan bool, 1)
+
+	monitor := newEventsMonitor(dockerClient, createEventsFilters(&eventMatcher{}), func(event events.Message) {
+		received <- event
+	}, func() {
+		reconnected <- true
+	})
+	monitor.minDelay = time.Millisecond
+	monitor.maxDelay = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go monitor.run(ctx)
+
+	select {
+	case <-reconnected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("events monitor didn't reconnect")
+	}
+
+	select {
+	case event := <-received:
+		assert.Equal(t, "start", event.Action)
+	case <-time.After(5 * time.Second):
+		t.Fatal("events monitor didn't deliver event after reconnection")
+	}
+
+	status := monitor.Status()
+	assert.Equal(t, EventsConnected, status.State)
+	assert.Equal(t, 1, status.Reconnects)
+	assert.Equal(t, "events stream closed", status.LastError)
+}
+
+func TestEventsMonitor_ResyncsWhenFirstConnectionFails(t *testing.T) {
+	for _, failPing := range []bool{true, false} {
+		var mutex sync.Mutex
+		attempts := 0
+
+		dockerClient := createBasicDockerClientMock()
+		dockerClient.MockPing = func(ctx context.Context) (types.Ping, error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			attempts++
+			if failPing && attempts == 1 {
+				// docker daemon isn't up yet when caddy starts
+				return types.Ping{}, fmt.Errorf("connection refused")
+			}
+			return types.Ping{}, nil
+		}
+		dockerClient.MockEvents = func(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error) {
+			errorChan := make(chan error, 1)
+			mutex.Lock()
+			if !failPing && attempts == 1 {
+				errorChan <- fmt.Errorf("connection refused")
+			}
+			mutex.Unlock()
+			return make(chan events.Message), errorChan
+		}
+
+		reconnected := make(chan bool, 1)
+
+		monitor := newEventsMonitor(dockerClient, createEventsFilters(&eventMatcher{}), func(event events.Message) {}, func() {
+			reconnected <- true
+		})
+		monitor.minDelay = time.Millisecond
+		monitor.maxDelay = 10 * time.Millisecond
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go monitor.run(ctx)
+
+		select {
+		case <-reconnected:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("events monitor didn't resync after first connection failed (ping failed: %v)", failPing)
+		}
+		cancel()
+
+		status := monitor.Status()
+		assert.Equal(t, 1, status.Reconnects)
+		assert.Equal(t, "connection refused", status.LastError)
+	}
+}
+
+func TestEventsMonitor_BackoffDelay(t *testing.T) {
+	for failures := 1; failures <= 10; failures++ {
+		delay := backoffDelay(failures, time.Second, 8*time.Second)
+
+		expected := time.Second << uint(failures-1)
+		if expected > 8*time.Second {
+			expected = 8 * time.Second
+		}
+
+		assert.True(t, delay >= expected/2, "delay %v for %v failures is too short", delay, failures)
+		assert.True(t, delay <= expected, "delay %v for %v failures is too long", delay, failures)
+	}
+}
@@ -0,0 +1,61 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/caddyserver/caddy"
+)
+
+// GenerateOnce connects to docker once and writes the generated caddyfile to output and generator logs to logsOutput,
+// without starting caddy. It fails when docker is unreachable, generator logs errors or caddyfile is invalid.
+func GenerateOnce(output io.Writer, logsOutput io.Writer) error {
+	endpoints, err := GetDockerEndpoints()
+	if err != nil {
+		return err
+	}
+
+	dockerLoader := CreateDockerLoader()
+	dockerLoader.options = GetLoaderOptions()
+	if err := dockerLoader.addEndpoints(endpoints, GetGeneratorOptions()); err != nil {
+		return err
+	}
+
+	return dockerLoader.generateOnce(context.Background(), output, logsOutput)
+}
+
+func (dockerLoader *DockerLoader) generateOnce(ctx context.Context, output io.Writer, logsOutput io.Writer) error {
+	for _, endpoint := range dockerLoader.endpoints {
+		if err := endpoint.cache.Resync(ctx); err != nil {
+			return fmt.Errorf("Docker connection failed%v: %v", endpoint.logSuffix(), err)
+		}
+	}
+
+	caddyfile, _, logs, err := generateCaddyfile(dockerLoader.generatorOptions, dockerLoader.generators())
+	io.WriteString(logsOutput, logs)
+	if err != nil {
+		return err
+	}
+
+	if dockerLoader.options.processCaddyfile {
+		caddyfile = ProcessCaddyfile(caddyfile)
+	}
+
+	output.Write(caddyfile)
+
+	input := caddy.CaddyfileInput{
+		ServerTypeName: "http",
+		Contents:       caddyfile,
+	}
+	if err := caddy.ValidateAndExecuteDirectives(input, nil, true); err != nil {
+		return fmt.Errorf("CaddyFile error: %v", err)
+	}
+
+	if strings.Contains(logs, "[ERROR]") {
+		return fmt.Errorf("Caddyfile generation logged errors")
+	}
+
+	return nil
+}
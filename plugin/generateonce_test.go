@@ -0,0 +1,59 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenerateOnce_WritesCaddyfileAndLogs(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ContainersData = []types.Container{
+		createTestContainer("container-id", "service.testdomain.com"),
+	}
+
+	var reloads int32
+	loader := createTestLoader(dockerClient, &reloads)
+
+	var output, logs bytes.Buffer
+	err := loader.generateOnce(context.Background(), &output, &logs)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "service.testdomain.com {\n  proxy / 172.17.0.2\n  tls off\n}\n", output.String())
+	assert.Equal(t, skipCaddyfileText, logs.String())
+	assert.Equal(t, int32(0), reloads)
+}
+
+func TestGenerateOnce_FailsOnGeneratorErrors(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	container := createTestContainer("container-id", "service.testdomain.com")
+	container.NetworkSettings.Networks["caddy-network"].NetworkID = "other-network-id"
+	dockerClient.ContainersData = []types.Container{container}
+
+	var reloads int32
+	loader := createTestLoader(dockerClient, &reloads)
+
+	var output, logs bytes.Buffer
+	err := loader.generateOnce(context.Background(), &output, &logs)
+
+	assert.Error(t, err)
+	assert.Contains(t, logs.String(), "[ERROR] Container container-id and caddy are not in same network\n")
+}
+
+func TestGenerateOnce_FailsWhenDockerIsUnreachable(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.InfoError = fmt.Errorf("Cannot connect to the Docker daemon")
+
+	var reloads int32
+	loader := createTestLoader(dockerClient, &reloads)
+
+	var output, logs bytes.Buffer
+	err := loader.generateOnce(context.Background(), &output, &logs)
+
+	assert.EqualError(t, err, "Docker connection failed: Cannot connect to the Docker daemon")
+	assert.Empty(t, output.String())
+}
@@ -3,22 +3,23 @@ package plugin
 import (
 	"bytes"
 	"context"
-	crand "crypto/rand"
 	"flag"
 	"fmt"
-	"html/template"
 	"io/ioutil"
 	"log"
-	"math"
-	"math/big"
-	rand "math/rand"
+	"net"
 	"os"
+	"reflect"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"text/template"
 	"time"
+	"unicode"
 
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
 	"github.com/docker/docker/api/types/swarm"
 )
 
@@ -26,6 +27,26 @@ var swarmAvailabilityCacheInterval = 1 * time.Minute
 
 var defaultLabelPrefix = "caddy"
 
+// Policies resolving conflicting directives of the same site defined by many docker objects
+const (
+	mergePolicyMerge    = "merge"
+	mergePolicyFirst    = "first"
+	mergePolicyPriority = "priority"
+	mergePolicyReject   = "reject"
+)
+
+// Targets of services with dnsrr endpoint mode, that don't have virtual IPs
+const (
+	dnsrrTargetsTasks = "tasks"
+	dnsrrTargetsDNS   = "dns"
+)
+
+// Fallbacks when no replica of a site is healthy
+const (
+	unhealthyFallbackAll  = "all"
+	unhealthyFallbackNone = "none"
+)
+
 // CaddyfileGenerator generates caddyfile
 type CaddyfileGenerator struct {
 	caddyFilePath        string
@@ -37,8 +58,24 @@ type CaddyfileGenerator struct {
 	dockerClient         DockerClient
 	dockerUtils          DockerUtils
 	caddyNetworks        map[string]bool
+	caddyNetworksStale   bool
+	initialCaddyNetworks map[string]bool
 	swarmIsAvailable     bool
 	swarmIsAvailableTime time.Time
+	hostName             string
+	targetAddress        string
+	publishedAddress     string
+	mergePolicy          string
+	sourceComments       bool
+	includeStarting      bool
+	unhealthyFallback    string
+	dnsrrTargets         string
+	preferredNetwork     string
+	connectNetworks      []string
+	disconnectNetworks   bool
+	hostNetworks         []string
+	hostCIDRs            []*net.IPNet
+	failedConnects       map[string]bool
 }
 
 var isTrue = regexp.MustCompile("(?i)^(true|yes|1)$")
@@ -49,6 +86,16 @@ var caddyFilePath string
 var ignoreSwarmErrorFlag bool
 var proxyServiceTasksFlag bool
 var validateNetworkFlag bool
+var mergePolicyFlag string
+var sourceCommentsFlag bool
+var includeStartingFlag bool
+var unhealthyFallbackFlag string
+var dnsrrTargetsFlag string
+var preferredNetworkFlag string
+var connectNetworksFlag string
+var disconnectNetworksFlag bool
+var hostNetworksFlag string
+var hostCIDRsFlag string
 
 func init() {
 	flag.StringVar(&labelPrefixFlag, "docker-label-prefix", defaultLabelPrefix, "Prefix for Docker labels")
@@ -56,15 +103,38 @@ func init() {
 	flag.BoolVar(&ignoreSwarmErrorFlag, "docker-ignore-swarm-error", false, "Skip updating caddyfile if swarm is unavailable")
 	flag.BoolVar(&proxyServiceTasksFlag, "proxy-service-tasks", false, "Proxy to service tasks instead of service load balancer")
 	flag.BoolVar(&validateNetworkFlag, "docker-validate-network", true, "Validates if caddy container and target are in same network")
+	flag.StringVar(&mergePolicyFlag, "docker-merge-policy", mergePolicyMerge, "Policy for conflicting directives of the same site: merge, first, priority or reject")
+	flag.BoolVar(&sourceCommentsFlag, "docker-source-comments", false, "Comments generated caddyfile with the docker objects each section came from")
+	flag.BoolVar(&includeStartingFlag, "docker-include-starting", false, "Proxy to containers whose healthcheck is still starting")
+	flag.StringVar(&unhealthyFallbackFlag, "docker-unhealthy-fallback", unhealthyFallbackAll, "Targets when no replica of a site is healthy: all or none")
+	flag.StringVar(&dnsrrTargetsFlag, "docker-dnsrr-targets", dnsrrTargetsTasks, "Targets of dnsrr endpoint mode services: tasks for task IPs, or dns for tasks.<service> name")
+	flag.StringVar(&preferredNetworkFlag, "docker-preferred-network", "", "Name or ID of the network to proxy to, when targets share many networks with caddy")
+	flag.StringVar(&connectNetworksFlag, "docker-connect-networks", "", "Network name patterns caddy container is connected to, when targets don't share a network with caddy")
+	flag.BoolVar(&disconnectNetworksFlag, "docker-disconnect-networks", false, "Disconnect caddy container from connected networks without targets")
+	flag.StringVar(&hostNetworksFlag, "docker-host-networks", "", "Network name patterns caddy can reach when running outside a container")
+	flag.StringVar(&hostCIDRsFlag, "docker-host-cidrs", "", "CIDRs caddy can route to when running outside a container")
 }
 
 // GeneratorOptions are the options for generator
 type GeneratorOptions struct {
-	caddyFilePath     string
-	labelPrefix       string
-	ignoreSwarmError  bool
-	proxyServiceTasks bool
-	validateNetwork   bool
+	caddyFilePath      string
+	labelPrefix        string
+	ignoreSwarmError   bool
+	proxyServiceTasks  bool
+	validateNetwork    bool
+	hostName           string
+	targetAddress      string
+	publishedAddress   string
+	mergePolicy        string
+	sourceComments     bool
+	includeStarting    bool
+	unhealthyFallback  string
+	dnsrrTargets       string
+	preferredNetwork   string
+	connectNetworks    []string
+	disconnectNetworks bool
+	hostNetworks       []string
+	hostCIDRs          []*net.IPNet
 }
 
 // GetGeneratorOptions creates generator options from cli flags and environment variables
@@ -101,6 +171,80 @@ func GetGeneratorOptions() *GeneratorOptions {
 		options.validateNetwork = validateNetworkFlag
 	}
 
+	if mergePolicyEnv := os.Getenv("CADDY_DOCKER_MERGE_POLICY"); mergePolicyEnv != "" {
+		options.mergePolicy = mergePolicyEnv
+	} else {
+		options.mergePolicy = mergePolicyFlag
+	}
+	switch options.mergePolicy {
+	case mergePolicyMerge, mergePolicyFirst, mergePolicyPriority, mergePolicyReject:
+	default:
+		log.Printf("[ERROR] Invalid merge policy %v, using %v", options.mergePolicy, mergePolicyMerge)
+		options.mergePolicy = mergePolicyMerge
+	}
+
+	if sourceCommentsEnv := os.Getenv("CADDY_DOCKER_SOURCE_COMMENTS"); sourceCommentsEnv != "" {
+		options.sourceComments = isTrue.MatchString(sourceCommentsEnv)
+	} else {
+		options.sourceComments = sourceCommentsFlag
+	}
+
+	if includeStartingEnv := os.Getenv("CADDY_DOCKER_INCLUDE_STARTING"); includeStartingEnv != "" {
+		options.includeStarting = isTrue.MatchString(includeStartingEnv)
+	} else {
+		options.includeStarting = includeStartingFlag
+	}
+
+	if unhealthyFallbackEnv := os.Getenv("CADDY_DOCKER_UNHEALTHY_FALLBACK"); unhealthyFallbackEnv != "" {
+		options.unhealthyFallback = unhealthyFallbackEnv
+	} else {
+		options.unhealthyFallback = unhealthyFallbackFlag
+	}
+	if options.unhealthyFallback != unhealthyFallbackAll && options.unhealthyFallback != unhealthyFallbackNone {
+		log.Printf("[ERROR] Invalid unhealthy fallback %v, using %v", options.unhealthyFallback, unhealthyFallbackAll)
+		options.unhealthyFallback = unhealthyFallbackAll
+	}
+
+	if dnsrrTargetsEnv := os.Getenv("CADDY_DOCKER_DNSRR_TARGETS"); dnsrrTargetsEnv != "" {
+		options.dnsrrTargets = dnsrrTargetsEnv
+	} else {
+		options.dnsrrTargets = dnsrrTargetsFlag
+	}
+	if options.dnsrrTargets != dnsrrTargetsTasks && options.dnsrrTargets != dnsrrTargetsDNS {
+		log.Printf("[ERROR] Invalid dnsrr targets %v, using %v", options.dnsrrTargets, dnsrrTargetsTasks)
+		options.dnsrrTargets = dnsrrTargetsTasks
+	}
+
+	if preferredNetworkEnv := os.Getenv("CADDY_DOCKER_PREFERRED_NETWORK"); preferredNetworkEnv != "" {
+		options.preferredNetwork = preferredNetworkEnv
+	} else {
+		options.preferredNetwork = preferredNetworkFlag
+	}
+
+	if connectNetworksEnv := os.Getenv("CADDY_DOCKER_CONNECT_NETWORKS"); connectNetworksEnv != "" {
+		options.connectNetworks = parseNetworkPatterns(connectNetworksEnv)
+	} else {
+		options.connectNetworks = parseNetworkPatterns(connectNetworksFlag)
+	}
+
+	if disconnectNetworksEnv := os.Getenv("CADDY_DOCKER_DISCONNECT_NETWORKS"); disconnectNetworksEnv != "" {
+		options.disconnectNetworks = isTrue.MatchString(disconnectNetworksEnv)
+	} else {
+		options.disconnectNetworks = disconnectNetworksFlag
+	}
+
+	if hostNetworksEnv := os.Getenv("CADDY_DOCKER_HOST_NETWORKS"); hostNetworksEnv != "" {
+		options.hostNetworks = parseNetworkPatterns(hostNetworksEnv)
+	} else {
+		options.hostNetworks = parseNetworkPatterns(hostNetworksFlag)
+	}
+
+	if hostCIDRsEnv := os.Getenv("CADDY_DOCKER_HOST_CIDRS"); hostCIDRsEnv != "" {
+		options.hostCIDRs = parseCIDRs(hostCIDRsEnv)
+	} else {
+		options.hostCIDRs = parseCIDRs(hostCIDRsFlag)
+	}
+
 	return &options
 }
 
@@ -109,32 +253,105 @@ func CreateGenerator(dockerClient DockerClient, dockerUtils DockerUtils, options
 	var labelRegexString = fmt.Sprintf("^%s(_\\d+)?(\\.|$)", options.labelPrefix)
 
 	return &CaddyfileGenerator{
-		caddyFilePath:     options.caddyFilePath,
-		dockerClient:      dockerClient,
-		dockerUtils:       dockerUtils,
-		labelPrefix:       options.labelPrefix,
-		labelRegex:        regexp.MustCompile(labelRegexString),
-		ignoreSwarmError:  options.ignoreSwarmError,
-		proxyServiceTasks: options.proxyServiceTasks,
-		validateNetwork:   options.validateNetwork,
+		caddyFilePath:      options.caddyFilePath,
+		dockerClient:       dockerClient,
+		dockerUtils:        dockerUtils,
+		labelPrefix:        options.labelPrefix,
+		labelRegex:         regexp.MustCompile(labelRegexString),
+		ignoreSwarmError:   options.ignoreSwarmError,
+		proxyServiceTasks:  options.proxyServiceTasks,
+		validateNetwork:    options.validateNetwork,
+		hostName:           options.hostName,
+		targetAddress:      options.targetAddress,
+		publishedAddress:   options.publishedAddress,
+		mergePolicy:        options.mergePolicy,
+		sourceComments:     options.sourceComments,
+		includeStarting:    options.includeStarting,
+		unhealthyFallback:  options.unhealthyFallback,
+		dnsrrTargets:       options.dnsrrTargets,
+		preferredNetwork:   options.preferredNetwork,
+		connectNetworks:    options.connectNetworks,
+		disconnectNetworks: options.disconnectNetworks,
+		hostNetworks:       options.hostNetworks,
+		hostCIDRs:          options.hostCIDRs,
 	}
 }
 
 // GenerateCaddyFile generates a caddy file config from docker swarm
 func (g *CaddyfileGenerator) GenerateCaddyFile() ([]byte, string, error) {
+	options := &GeneratorOptions{
+		caddyFilePath:     g.caddyFilePath,
+		mergePolicy:       g.mergePolicy,
+		sourceComments:    g.sourceComments,
+		unhealthyFallback: g.unhealthyFallback,
+	}
+	caddyfile, _, logs, err := generateCaddyfile(options, []*CaddyfileGenerator{g})
+	return caddyfile, logs, err
+}
+
+// generateCaddyfile generates a single caddy file merging the directives from multiple docker hosts.
+// It also returns the merged directives, that must not be changed afterwards.
+func generateCaddyfile(options *GeneratorOptions, generators []*CaddyfileGenerator) ([]byte, map[string]*directiveData, string, error) {
 	var caddyfileBuffer bytes.Buffer
 	var logsBuffer bytes.Buffer
 
-	if g.validateNetwork && g.caddyNetworks == nil {
-		networks, err := g.getCaddyNetworks()
+	for _, g := range generators {
+		if err := g.prepare(&logsBuffer); err != nil {
+			return nil, nil, logsBuffer.String(), err
+		}
+	}
+
+	if options.caddyFilePath != "" {
+		dat, err := ioutil.ReadFile(options.caddyFilePath)
+
 		if err == nil {
-			g.caddyNetworks = map[string]bool{}
-			for _, network := range networks {
-				g.caddyNetworks[network] = true
-			}
-		} else {
+			source := "default caddyfile " + options.caddyFilePath
+			writeSourceStart(&caddyfileBuffer, options.sourceComments, source)
+			_, err = caddyfileBuffer.Write(dat)
+			writeSourceEnd(&caddyfileBuffer, options.sourceComments, source)
+		}
+
+		if err != nil {
 			logsBuffer.WriteString(fmt.Sprintf("[ERROR] %v\n", err.Error()))
 		}
+	} else {
+		logsBuffer.WriteString("[INFO] Skipping default CaddyFile because no path is set\n")
+	}
+
+	sites := []*siteSource{}
+	for i, g := range generators {
+		generatorSites, err := g.collectDirectives(&logsBuffer)
+		if err != nil {
+			return nil, nil, logsBuffer.String(), err
+		}
+		for _, site := range generatorSites {
+			site.hostIndex = i
+		}
+		sites = append(sites, generatorSites...)
+	}
+
+	directives, err := mergeSites(sites, options.mergePolicy, options.unhealthyFallback, &logsBuffer)
+	if err != nil {
+		return nil, nil, logsBuffer.String(), err
+	}
+
+	for _, g := range generators {
+		if err := g.collectConfigs(&caddyfileBuffer, &logsBuffer); err != nil {
+			return nil, nil, logsBuffer.String(), err
+		}
+	}
+
+	// hosts are only worth commenting when sites may come from many of them
+	hostComments := options.sourceComments || len(generators) > 1
+	writeDirectives(&caddyfileBuffer, directives, 0, options.sourceComments, hostComments, nil)
+
+	return caddyfileBuffer.Bytes(), directives, logsBuffer.String(), nil
+}
+
+// prepare refreshes caddy networks and swarm availability of generator docker host
+func (g *CaddyfileGenerator) prepare(logsBuffer *bytes.Buffer) error {
+	if g.validateNetwork && g.targetAddress != targetAddressPublished && (g.caddyNetworks == nil || g.caddyNetworksStale) {
+		g.refreshCaddyNetworks(logsBuffer)
 	}
 
 	if time.Since(g.swarmIsAvailableTime) > swarmAvailabilityCacheInterval {
@@ -144,39 +361,60 @@ func (g *CaddyfileGenerator) GenerateCaddyFile() ([]byte, string, error) {
 
 	if g.ignoreSwarmError && !g.swarmIsAvailable {
 		// return error to skip updating caddyfile
-		return nil, logsBuffer.String(), fmt.Errorf("swarm is unavailable")
+		return fmt.Errorf("swarm is unavailable")
 	}
 
-	directives := map[string]*directiveData{}
+	if len(g.connectNetworks) > 0 && !g.isHostMode() && g.validateNetwork && g.targetAddress != targetAddressPublished && g.caddyNetworks != nil {
+		g.connectTargetNetworks(logsBuffer)
+	}
 
-	if g.caddyFilePath != "" {
-		dat, err := ioutil.ReadFile(g.caddyFilePath)
+	return nil
+}
 
-		if err == nil {
-			_, err = caddyfileBuffer.Write(dat)
-		}
+// refreshCaddyNetworks inspects the networks caddy container is attached to
+func (g *CaddyfileGenerator) refreshCaddyNetworks(logsBuffer *bytes.Buffer) {
+	networks, err := g.getCaddyNetworks()
+	if err != nil {
+		// stale networks are kept until caddy container can be inspected again
+		g.logError(logsBuffer, err)
+		return
+	}
 
-		if err != nil {
-			logsBuffer.WriteString(fmt.Sprintf("[ERROR] %v\n", err.Error()))
+	caddyNetworks := map[string]bool{}
+	for _, network := range networks {
+		caddyNetworks[network] = true
+	}
+	if g.caddyNetworks != nil && !reflect.DeepEqual(g.caddyNetworks, caddyNetworks) {
+		g.logInfo(logsBuffer, fmt.Sprintf("Caddy networks changed from %v to %v", getSortedNetworks(g.caddyNetworks), networks))
+	}
+	if g.initialCaddyNetworks == nil {
+		// networks caddy was started with are never disconnected
+		g.initialCaddyNetworks = map[string]bool{}
+		for _, network := range networks {
+			g.initialCaddyNetworks[network] = true
 		}
-	} else {
-		logsBuffer.WriteString("[INFO] Skipping default CaddyFile because no path is set\n")
 	}
+	g.caddyNetworks = caddyNetworks
+	g.caddyNetworksStale = false
+}
+
+// collectDirectives reads site directives from containers and services labels
+func (g *CaddyfileGenerator) collectDirectives(logsBuffer *bytes.Buffer) ([]*siteSource, error) {
+	sites := []*siteSource{}
 
 	containers, err := g.dockerClient.ContainerList(context.Background(), types.ContainerListOptions{})
 	if err == nil {
 		for _, container := range containers {
 			containerDirectives, err := g.getContainerDirectives(&container)
 			if err == nil {
-				for k, directive := range containerDirectives {
-					directives[k] = mergeDirectives(directives[k], directive)
-				}
+				unhealthy := !g.isContainerHealthy(&container)
+				sites = g.addSiteSources(sites, containerDirectives, getContainerSource(&container), container.ID, unhealthy)
 			} else {
-				logsBuffer.WriteString(fmt.Sprintf("[ERROR] %v\n", err.Error()))
+				g.logError(logsBuffer, err)
 			}
 		}
 	} else {
-		logsBuffer.WriteString(fmt.Sprintf("[ERROR] %v\n", err.Error()))
+		g.logError(logsBuffer, err)
 	}
 
 	if g.swarmIsAvailable {
@@ -185,60 +423,162 @@ func (g *CaddyfileGenerator) GenerateCaddyFile() ([]byte, string, error) {
 			for _, service := range services {
 				serviceDirectives, err := g.getServiceDirectives(&service)
 				if err == nil {
-					for k, directive := range serviceDirectives {
-						directives[k] = mergeDirectives(directives[k], directive)
-					}
+					sites = g.addSiteSources(sites, serviceDirectives, getServiceSource(&service), service.ID, false)
 				} else {
-					logsBuffer.WriteString(fmt.Sprintf("[ERROR] %v\n", err.Error()))
+					g.logError(logsBuffer, err)
 					if g.ignoreSwarmError {
 						// return error to skip updating caddyfile
-						return nil, logsBuffer.String(), fmt.Errorf("swarm is unavailable for getServiceDirectives")
+						return nil, fmt.Errorf("swarm is unavailable for getServiceDirectives")
 					}
 				}
 			}
 		} else {
-			logsBuffer.WriteString(fmt.Sprintf("[ERROR] %v\n", err.Error()))
+			g.logError(logsBuffer, err)
 			if g.ignoreSwarmError {
 				// return error to skip updating caddyfile
-				return nil, logsBuffer.String(), fmt.Errorf("swarm is unavailable for ServiceList")
+				return nil, fmt.Errorf("swarm is unavailable for ServiceList")
 			}
 		}
 	} else {
-		logsBuffer.WriteString("[INFO] Skipping services because swarm is not available\n")
+		g.logInfo(logsBuffer, "Skipping services because swarm is not available")
 	}
 
-	if g.swarmIsAvailable {
-		configs, err := g.dockerClient.ConfigList(context.Background(), types.ConfigListOptions{})
-		if err == nil {
-			for _, config := range configs {
-				if _, hasLabel := config.Spec.Labels[g.labelPrefix]; hasLabel {
-					fullConfig, _, err := g.dockerClient.ConfigInspectWithRaw(context.Background(), config.ID)
-					if err == nil {
-						caddyfileBuffer.Write(fullConfig.Spec.Data)
-						caddyfileBuffer.WriteRune('\n')
-					} else {
-						logsBuffer.WriteString(fmt.Sprintf("[ERROR] %v\n", err.Error()))
-						if g.ignoreSwarmError {
-							// return error to skip updating caddyfile
-							return nil, logsBuffer.String(), fmt.Errorf("swarm is unavailable for ConfigInspectWithRaw")
-						}
-					}
+	return sites, nil
+}
+
+// collectConfigs writes the content of docker configs with caddy label
+func (g *CaddyfileGenerator) collectConfigs(caddyfileBuffer *bytes.Buffer, logsBuffer *bytes.Buffer) error {
+	if !g.swarmIsAvailable {
+		g.logInfo(logsBuffer, "Skipping configs because swarm is not available")
+		return nil
+	}
+
+	configs, err := g.dockerClient.ConfigList(context.Background(), types.ConfigListOptions{})
+	if err != nil {
+		g.logError(logsBuffer, err)
+		if g.ignoreSwarmError {
+			// return error to skip updating caddyfile
+			return fmt.Errorf("swarm is unavailable for ConfigList")
+		}
+		return nil
+	}
+
+	for _, config := range configs {
+		if _, hasLabel := config.Spec.Labels[g.labelPrefix]; hasLabel {
+			fullConfig, _, err := g.dockerClient.ConfigInspectWithRaw(context.Background(), config.ID)
+			if err == nil {
+				source := getConfigSource(&fullConfig)
+				writeSourceStart(caddyfileBuffer, g.sourceComments, source)
+				caddyfileBuffer.Write(fullConfig.Spec.Data)
+				caddyfileBuffer.WriteRune('\n')
+				writeSourceEnd(caddyfileBuffer, g.sourceComments, source)
+			} else {
+				g.logError(logsBuffer, err)
+				if g.ignoreSwarmError {
+					// return error to skip updating caddyfile
+					return fmt.Errorf("swarm is unavailable for ConfigInspectWithRaw")
 				}
 			}
-		} else {
-			logsBuffer.WriteString(fmt.Sprintf("[ERROR] %v\n", err.Error()))
-			if g.ignoreSwarmError {
-				// return error to skip updating caddyfile
-				return nil, logsBuffer.String(), fmt.Errorf("swarm is unavailable for ConfigList")
-			}
 		}
-	} else {
-		logsBuffer.WriteString("[INFO] Skipping configs because swarm is not available\n")
 	}
 
-	writeDirectives(&caddyfileBuffer, directives, 0)
+	return nil
+}
 
-	return caddyfileBuffer.Bytes(), logsBuffer.String(), nil
+// getConfigSource describes a docker config as the source of a caddyfile section
+func getConfigSource(config *swarm.Config) string {
+	return fmt.Sprintf("config %v (%v)", config.Spec.Name, config.ID)
+}
+
+// writeSourceStart marks the start of a caddyfile section copied from source
+func writeSourceStart(buffer *bytes.Buffer, sourceComments bool, source string) {
+	if sourceComments {
+		buffer.WriteString("# source: " + source + "\n")
+	}
+}
+
+// writeSourceEnd marks the end of a caddyfile section copied from source
+func writeSourceEnd(buffer *bytes.Buffer, sourceComments bool, source string) {
+	if !sourceComments {
+		return
+	}
+	if buffer.Len() > 0 && buffer.Bytes()[buffer.Len()-1] != '\n' {
+		buffer.WriteRune('\n')
+	}
+	buffer.WriteString("# end of source: " + source + "\n")
+}
+
+// siteSource is a site defined by a single docker object, before being merged with other objects
+type siteSource struct {
+	key       string
+	directive *directiveData
+	hostIndex int
+	sourceID  string
+	unhealthy bool
+}
+
+// addSiteSources appends site directives, recording the docker host and object they came from
+func (g *CaddyfileGenerator) addSiteSources(sites []*siteSource, newDirectives map[string]*directiveData, source string, sourceID string, unhealthy bool) []*siteSource {
+	for k, directive := range newDirectives {
+		if g.hostName != "" {
+			directive.addHosts(g.hostName)
+		}
+		directive.addSources(source)
+		for _, child := range directive.children {
+			child.addSources(source)
+		}
+		sites = append(sites, &siteSource{key: k, directive: directive, sourceID: sourceID, unhealthy: unhealthy})
+	}
+	return sites
+}
+
+// mergeSites merges sites with the same address, ordered by priority, docker host and object ID,
+// so the same docker state always generates the same caddyfile
+func mergeSites(sites []*siteSource, mergePolicy string, unhealthyFallback string, logsBuffer *bytes.Buffer) (map[string]*directiveData, error) {
+	sort.SliceStable(sites, func(i, j int) bool {
+		a, b := sites[i], sites[j]
+		if a.directive.priority != b.directive.priority {
+			return a.directive.priority > b.directive.priority
+		}
+		if a.hostIndex != b.hostIndex {
+			return a.hostIndex < b.hostIndex
+		}
+		if a.sourceID != b.sourceID {
+			return a.sourceID < b.sourceID
+		}
+		return a.key < b.key
+	})
+
+	groupedSites, err := groupReplicas(filterUnhealthy(sites, unhealthyFallback, logsBuffer), mergePolicy, logsBuffer)
+	if err != nil {
+		return nil, err
+	}
+
+	directives := map[string]*directiveData{}
+	for _, site := range groupedSites {
+		directive, err := mergeDirectives(directives[site.key], site.directive, mergePolicy, logsBuffer)
+		if err != nil {
+			return nil, err
+		}
+		directives[site.key] = directive
+	}
+	return directives, nil
+}
+
+func (g *CaddyfileGenerator) logError(logsBuffer *bytes.Buffer, err error) {
+	g.writeLog(logsBuffer, "ERROR", err.Error())
+}
+
+func (g *CaddyfileGenerator) logInfo(logsBuffer *bytes.Buffer, message string) {
+	g.writeLog(logsBuffer, "INFO", message)
+}
+
+// writeLog writes a generator log line, identifying the docker host when there are many
+func (g *CaddyfileGenerator) writeLog(logsBuffer *bytes.Buffer, level string, message string) {
+	if g.hostName != "" {
+		message = fmt.Sprintf("Host %v: %v", g.hostName, message)
+	}
+	logsBuffer.WriteString(fmt.Sprintf("[%v] %v\n", level, message))
 }
 
 func (g *CaddyfileGenerator) checkSwarmAvailability(isFirstCheck bool) {
@@ -256,6 +596,10 @@ func (g *CaddyfileGenerator) checkSwarmAvailability(isFirstCheck bool) {
 }
 
 func (g *CaddyfileGenerator) getCaddyNetworks() ([]string, error) {
+	if g.isHostMode() {
+		return g.getHostNetworks()
+	}
+
 	containerID, err := g.dockerUtils.GetCurrentContainerID()
 	if err != nil {
 		return nil, err
@@ -276,18 +620,50 @@ func (g *CaddyfileGenerator) getCaddyNetworks() ([]string, error) {
 			networks = append(networks, network.NetworkID)
 		}
 	}
+	sort.Strings(networks)
 	log.Printf("[INFO] Caddy Networks: %v\n", networks)
 
 	return networks, nil
 }
 
-func (g *CaddyfileGenerator) parseDirectives(labels map[string]string, templateData interface{}, getProxyTargets func() ([]string, error)) (map[string]*directiveData, error) {
-	originalMap := g.convertLabelsToDirectives(labels, templateData)
+// invalidateCaddyNetworks makes next generation inspect caddy container networks again
+func (g *CaddyfileGenerator) invalidateCaddyNetworks() {
+	g.caddyNetworksStale = true
+}
+
+// isCaddyNetworkEvent tells if event changes the networks caddy can reach
+func (g *CaddyfileGenerator) isCaddyNetworkEvent(event events.Message) bool {
+	if g.isHostMode() {
+		// networks matching host mode configuration may be created later or recreated with new IDs
+		return event.Type == "network" && (event.Action == "create" || event.Action == "destroy")
+	}
+	if event.Type != "network" || (event.Action != "connect" && event.Action != "disconnect") {
+		return false
+	}
+	containerID, err := g.dockerUtils.GetCurrentContainerID()
+	return err == nil && containerID != "" && event.Actor.Attributes["container"] == containerID
+}
+
+func getSortedNetworks(networks map[string]bool) []string {
+	result := []string{}
+	for network := range networks {
+		result = append(result, network)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func (g *CaddyfileGenerator) parseDirectives(labels map[string]string, templateData *TemplateContext, source string, getProxyTargets func(targetPort string, network string) ([]string, error)) (map[string]*directiveData, error) {
+	originalMap, err := g.convertLabelsToDirectives(labels, templateData, source, templateFuncs(getProxyTargets))
+	if err != nil {
+		return nil, err
+	}
 
 	convertedMap := map[string]*directiveData{}
 
-	//Convert basic labels
-	for _, directive := range originalMap {
+	//Convert basic labels, in label order so sites declared twice are always merged the same way
+	for _, key := range getSortedKeys(originalMap) {
+		directive := originalMap[key]
 		address := directive.children["address"]
 
 		if address != nil && len(address.args) > 0 {
@@ -297,11 +673,24 @@ func (g *CaddyfileGenerator) parseDirectives(labels map[string]string, templateD
 			targetPort := directive.children["targetport"]
 			targetPath := directive.children["targetpath"]
 			targetProtocol := directive.children["targetprotocol"]
+			lbPolicy := directive.children["lbpolicy"]
+			healthCheck := directive.children["healthcheck"]
+			network := directive.children["network"]
 
 			proxyDirective := getOrCreateDirective(directive.children, "proxy", false)
 
 			if len(proxyDirective.args) == 0 {
-				proxyTargets, err := getProxyTargets()
+				targetPortArg := ""
+				if targetPort != nil && len(targetPort.args) > 0 {
+					targetPortArg = targetPort.args[0]
+				}
+
+				networkArg := ""
+				if network != nil && len(network.args) > 0 {
+					networkArg = network.args[0]
+				}
+
+				proxyTargets, err := getProxyTargets(targetPortArg, networkArg)
 				if err != nil {
 					return nil, err
 				}
@@ -320,34 +709,150 @@ func (g *CaddyfileGenerator) parseDirectives(labels map[string]string, templateD
 
 					targetArg += target
 
-					if targetPort != nil && len(targetPort.args) > 0 {
-						targetArg += ":" + targetPort.args[0]
-					}
 					if targetPath != nil && len(targetPath.args) > 0 {
 						targetArg += targetPath.args[0]
 					}
 
 					proxyDirective.addArgs(targetArg)
 				}
+
+				if lbPolicy != nil && len(lbPolicy.args) > 0 {
+					getOrCreateDirective(proxyDirective.children, "policy", false).args = lbPolicy.args
+				}
+				if healthCheck != nil && len(healthCheck.args) > 0 {
+					getOrCreateDirective(proxyDirective.children, "health_check", false).args = healthCheck.args
+				}
+
+				directive.generatedProxy = proxyDirective
+			}
+		}
+
+		// containers of the same compose or swarm service are replicas, unless grouped explicitly
+		if group := directive.children["group"]; group != nil && len(group.args) > 0 {
+			directive.replicaGroup = group.args[0]
+		} else if templateData.Kind == "container" && templateData.ServiceName != "" {
+			directive.replicaGroup = templateData.ProjectName + "/" + templateData.ServiceName
+		}
+
+		if priority := directive.children["priority"]; priority != nil && len(priority.args) > 0 {
+			value, err := strconv.Atoi(priority.args[0])
+			if err != nil {
+				return nil, fmt.Errorf("Invalid site priority %v of %v", priority.args[0], source)
 			}
+			directive.priority = value
 		}
 
 		delete(directive.children, "address")
+		delete(directive.children, "group")
+		delete(directive.children, "healthcheck")
+		delete(directive.children, "lbpolicy")
+		delete(directive.children, "network")
+		delete(directive.children, "priority")
 		delete(directive.children, "sourcepath")
 		delete(directive.children, "targetport")
 		delete(directive.children, "targetpath")
 		delete(directive.children, "targetprotocol")
 
+		for _, arg := range directive.args {
+			// caddyfile parser imports files when a site starts with import
+			if !isPlainArg(arg) || arg == "import" {
+				return nil, fmt.Errorf("Invalid site address %v of %v", quoteArg(arg), source)
+			}
+		}
+
 		//Move sites directive to main
 		directive.name = strings.Join(directive.args, " ")
 		directive.args = []string{}
 
-		convertedMap[directive.name] = directive
+		// label groups of the same object don't conflict, merge policy is only applied between objects
+		merged, err := mergeDirectives(convertedMap[directive.name], directive, mergePolicyMerge, nil)
+		if err != nil {
+			return nil, err
+		}
+		convertedMap[directive.name] = merged
 	}
 
 	return convertedMap, nil
 }
 
+// addTargetPort appends target port to each target address
+func addTargetPort(targets []string, targetPort string) []string {
+	if targetPort == "" {
+		return targets
+	}
+	result := []string{}
+	for _, target := range targets {
+		result = append(result, target+":"+targetPort)
+	}
+	return result
+}
+
+// networkAddress is the address of a proxy target in one docker network
+type networkAddress struct {
+	networkID   string
+	networkName string
+	address     string
+}
+
+// selectNetworkAddress picks a single address of a target attached to many networks.
+// The network label value is required, otherwise preferred network is used when shared with caddy.
+func (g *CaddyfileGenerator) selectNetworkAddress(target string, addresses []networkAddress, network string) (string, error) {
+	if network != "" {
+		for _, address := range addresses {
+			if address.networkID == network || address.networkName == network {
+				if g.validateNetwork && !g.canReach(address) {
+					return "", fmt.Errorf("%v network %v isn't shared with caddy", target, network)
+				}
+				return address.address, nil
+			}
+		}
+		return "", fmt.Errorf("%v isn't attached to network %v", target, network)
+	}
+
+	shared := []networkAddress{}
+	for _, address := range addresses {
+		if !g.validateNetwork || g.canReach(address) {
+			shared = append(shared, address)
+		}
+	}
+	if len(shared) == 0 {
+		return "", fmt.Errorf("%v and caddy are not in same network", target)
+	}
+
+	for _, address := range shared {
+		if g.preferredNetwork != "" && (address.networkID == g.preferredNetwork || address.networkName == g.preferredNetwork) {
+			return address.address, nil
+		}
+	}
+
+	// without a preference, pick the same network on every generation
+	sort.Slice(shared, func(i, j int) bool {
+		if shared[i].networkName != shared[j].networkName {
+			return shared[i].networkName < shared[j].networkName
+		}
+		return shared[i].networkID < shared[j].networkID
+	})
+	return shared[0].address, nil
+}
+
+// canReach tells if caddy can reach a target address, by sharing its network or routing to its CIDR
+func (g *CaddyfileGenerator) canReach(address networkAddress) bool {
+	if g.caddyNetworks[address.networkID] {
+		return true
+	}
+	ip := net.ParseIP(address.address)
+	if ip == nil {
+		// service virtual IPs include network prefix length
+		ip, _, _ = net.ParseCIDR(address.address)
+	}
+	for _, cidr := range g.hostCIDRs {
+		if ip != nil && cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 func getOrCreateDirective(directiveMap map[string]*directiveData, path string, skipFirstDirectiveName bool) (directive *directiveData) {
 	currentMap := directiveMap
 	for i, p := range strings.Split(path, ".") {
@@ -368,61 +873,147 @@ func getOrCreateDirective(directiveMap map[string]*directiveData, path string, s
 	return
 }
 
-func (g *CaddyfileGenerator) convertLabelsToDirectives(labels map[string]string, templateData interface{}) map[string]*directiveData {
+func (g *CaddyfileGenerator) convertLabelsToDirectives(labels map[string]string, templateData *TemplateContext, source string, funcs template.FuncMap) (map[string]*directiveData, error) {
 	directiveMap := map[string]*directiveData{}
 
-	for label, value := range labels {
+	for _, label := range getSortedLabels(labels) {
 		if !g.labelRegex.MatchString(label) {
 			continue
 		}
+		argsText, err := renderTemplate(labels[label], templateData, funcs)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid label %v of %v: %v", label, source, err)
+		}
+		args := parseArgs(argsText)
+		if err := validateLabel(label, args); err != nil {
+			return nil, fmt.Errorf("Invalid label %v of %v: %v", label, source, err)
+		}
 		directive := getOrCreateDirective(directiveMap, label, true)
-		argsText := processVariables(templateData, value)
-		directive.args = parseArgs(argsText)
+		directive.args = args
 	}
 
-	return directiveMap
+	return directiveMap, nil
 }
 
-func processVariables(data interface{}, content string) string {
-	t, err := template.New("").Parse(content)
-	if err != nil {
-		log.Println(err)
-		return content
+func getSortedLabels(labels map[string]string) []string {
+	keys := []string{}
+	for key := range labels {
+		keys = append(keys, key)
 	}
-	var writer bytes.Buffer
-	t.Execute(&writer, data)
-	return writer.String()
+	sort.Strings(keys)
+	return keys
 }
 
+// validateLabel rejects labels that would change caddyfile structure instead of configuring a directive,
+// like directive names with spaces, arguments opening and closing blocks or arguments that can't be quoted.
+// It also rejects environment variable placeholders, so labels can't read caddy environment.
+func validateLabel(label string, args []string) error {
+	for i, name := range strings.Split(label, ".") {
+		if i > 0 && (!isPlainArg(name) || hasEnvPlaceholder(name)) {
+			return fmt.Errorf("directive name %v is not allowed", quoteArg(name))
+		}
+		if i > 0 && removeSuffix(name) == "import" {
+			// caddyfile parser imports files into blocks too
+			return fmt.Errorf("directive import is not allowed")
+		}
+	}
+	for _, arg := range args {
+		if arg == "{" || arg == "}" {
+			// caddyfile parser opens and closes blocks even with quoted braces
+			return fmt.Errorf("argument %v is a caddyfile block delimiter", arg)
+		}
+		if hasEnvPlaceholder(arg) {
+			// caddyfile parser replaces them in every token, even quoted ones
+			return fmt.Errorf("argument %v has a caddyfile environment variable placeholder", quoteArg(arg))
+		}
+		if written := parseArgs(quoteArg(arg)); len(written) != 1 || written[0] != arg {
+			// caddyfile can't escape a backslash before a quote, so some arguments can't be written back
+			return fmt.Errorf("argument %v can't be written to caddyfile", quoteArg(arg))
+		}
+	}
+	return nil
+}
+
+// hasEnvPlaceholder tells if caddyfile parser would replace part of a token with an environment variable, like {$VAR} or {%VAR%}
+func hasEnvPlaceholder(token string) bool {
+	return strings.Contains(token, "{$") || strings.Contains(token, "{%")
+}
+
+// isPlainArg tells if an argument is written to caddyfile as is, and is not a block delimiter
+func isPlainArg(arg string) bool {
+	return quoteArg(arg) == arg && arg != "{" && arg != "}"
+}
+
+// parseArgs splits label values into arguments following caddyfile quoting rules.
+// Double quotes starting an argument allow spaces, and \" escapes quotes inside them, other backslashes are kept.
 func parseArgs(text string) []string {
-	args := regSplit(text, "\\s+")
-	if len(args) == 1 && args[0] == "" {
-		return []string{}
+	args := []string{}
+	var arg []rune
+	inArg, quoted, escaped := false, false, false
+
+	for _, ch := range text {
+		switch {
+		case quoted && escaped:
+			// like caddyfile lexer, only quotes are escaped
+			if ch != '"' {
+				arg = append(arg, '\\')
+			}
+			arg = append(arg, ch)
+			escaped = false
+		case quoted && ch == '\\':
+			escaped = true
+		case quoted && ch == '"':
+			args = append(args, string(arg))
+			arg = nil
+			inArg, quoted = false, false
+		case quoted:
+			arg = append(arg, ch)
+		case unicode.IsSpace(ch):
+			if inArg {
+				args = append(args, string(arg))
+				arg = nil
+				inArg = false
+			}
+		case !inArg && ch == '"':
+			inArg, quoted = true, true
+		default:
+			arg = append(arg, ch)
+			inArg = true
+		}
+	}
+
+	if inArg {
+		args = append(args, string(arg))
 	}
 	return args
 }
 
-func regSplit(text string, delimeter string) []string {
-	reg := regexp.MustCompile(delimeter)
-	indexes := reg.FindAllStringIndex(text, -1)
-	laststart := 0
-	result := make([]string, len(indexes)+1)
-	for i, element := range indexes {
-		result[i] = text[laststart:element[0]]
-		laststart = element[1]
+// quoteArg quotes arguments that caddyfile would otherwise split or ignore
+func quoteArg(arg string) string {
+	if arg != "" && !strings.HasPrefix(arg, "\"") && !strings.ContainsAny(arg, "# \t\r\n") {
+		return arg
 	}
-	result[len(indexes)] = text[laststart:len(text)]
-	return result
+	return "\"" + strings.Replace(arg, "\"", "\\\"", -1) + "\""
 }
 
-func writeDirectives(buffer *bytes.Buffer, directives map[string]*directiveData, level int) {
+func writeDirectives(buffer *bytes.Buffer, directives map[string]*directiveData, level int, sourceComments bool, hostComments bool, parentSources []string) {
 	for _, name := range getSortedKeys(directives) {
 		subdirective := directives[name]
-		writeDirective(buffer, subdirective, level)
+		writeDirective(buffer, subdirective, level, sourceComments, hostComments, parentSources)
 	}
 }
 
-func writeDirective(buffer *bytes.Buffer, directive *directiveData, level int) {
+// writeDirective writes a directive and its children.
+// Source comments are only written when directive sources differ from its parent ones.
+func writeDirective(buffer *bytes.Buffer, directive *directiveData, level int, sourceComments bool, hostComments bool, parentSources []string) {
+	if hostComments && len(directive.hosts) > 0 {
+		buffer.WriteString(strings.Repeat(" ", level*2))
+		buffer.WriteString("# docker hosts: " + strings.Join(directive.hosts, ", ") + "\n")
+	}
+	if sourceComments && len(directive.sources) > 0 && strings.Join(directive.sources, ", ") != strings.Join(parentSources, ", ") {
+		buffer.WriteString(strings.Repeat(" ", level*2))
+		buffer.WriteString("# source: " + strings.Join(directive.sources, ", ") + "\n")
+	}
 	buffer.WriteString(strings.Repeat(" ", level*2))
 	if directive.name != "" {
 		buffer.WriteString(directive.name)
@@ -435,12 +1026,12 @@ func writeDirective(buffer *bytes.Buffer, directive *directiveData, level int) {
 			if index > 0 {
 				buffer.WriteString(" ")
 			}
-			buffer.WriteString(arg)
+			buffer.WriteString(quoteArg(arg))
 		}
 	}
 	if len(directive.children) > 0 {
 		buffer.WriteString(" {\n")
-		writeDirectives(buffer, directive.children, level+1)
+		writeDirectives(buffer, directive.children, level+1, sourceComments, hostComments, directive.sources)
 		buffer.WriteString(strings.Repeat(" ", level*2) + "}")
 	}
 	buffer.WriteString("\n")
@@ -468,40 +1059,182 @@ type directiveData struct {
 	name     string
 	args     []string
 	children map[string]*directiveData
+	hosts    []string
+	sources  []string
+	priority int
+
+	// site replica group and its proxy directive generated from basic labels
+	replicaGroup   string
+	generatedProxy *directiveData
 }
 
 func (directive *directiveData) addArgs(args ...string) {
 	directive.args = append(directive.args, args...)
 }
 
-func mergeDirectives(directiveA *directiveData, directiveB *directiveData) *directiveData {
+func (directive *directiveData) addHosts(hosts ...string) {
+	directive.hosts = appendUnique(directive.hosts, hosts...)
+}
+
+func (directive *directiveData) addSources(sources ...string) {
+	directive.sources = appendUnique(directive.sources, sources...)
+}
+
+func appendUnique(list []string, items ...string) []string {
+	for _, item := range items {
+		found := false
+		for _, existing := range list {
+			found = found || existing == item
+		}
+		if !found {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// filterUnhealthy removes sites of unhealthy containers, unless no replica of the site is healthy
+// and unhealthy fallback proxies to all of them
+func filterUnhealthy(sites []*siteSource, unhealthyFallback string, logsBuffer *bytes.Buffer) []*siteSource {
+	healthyReplicas := map[string]bool{}
+	for _, site := range sites {
+		if !site.unhealthy {
+			healthyReplicas[getReplicaKey(site)] = true
+		}
+	}
+
+	result := []*siteSource{}
+	for _, site := range sites {
+		if site.unhealthy {
+			sources := strings.Join(site.directive.sources, ", ")
+			if healthyReplicas[getReplicaKey(site)] || unhealthyFallback == unhealthyFallbackNone {
+				logsBuffer.WriteString(fmt.Sprintf("[INFO] Skipping site %v of unhealthy %v\n", site.key, sources))
+				continue
+			}
+			logsBuffer.WriteString(fmt.Sprintf("[WARN] Proxying site %v to unhealthy %v because no replica is healthy\n", site.key, sources))
+		}
+		result = append(result, site)
+	}
+	return result
+}
+
+// getReplicaKey identifies the sites that replace each other when some are unhealthy:
+// sites of the same replica group, or generated proxies to the same path, or else the site itself
+func getReplicaKey(site *siteSource) string {
+	if site.directive.replicaGroup != "" {
+		return site.key + " group " + site.directive.replicaGroup
+	}
+	if site.directive.generatedProxy != nil {
+		return site.key + " path " + site.directive.generatedProxy.args[0]
+	}
+	return site.key + " source " + site.sourceID
+}
+
+// groupReplicas merges sites of replicas in the same group into the first replica site,
+// adding the targets of every replica to its generated proxy directive.
+// Other directives of replicas are merged with merge policy, like sites of different objects.
+func groupReplicas(sites []*siteSource, mergePolicy string, logsBuffer *bytes.Buffer) ([]*siteSource, error) {
+	result := []*siteSource{}
+	firstReplicas := map[string]*directiveData{}
+
+	for _, site := range sites {
+		replica := site.directive
+		if replica.replicaGroup == "" || replica.generatedProxy == nil {
+			result = append(result, site)
+			continue
+		}
+
+		replicaKey := site.key + " " + replica.replicaGroup
+		first, exists := firstReplicas[replicaKey]
+		if !exists || first.generatedProxy.args[0] != replica.generatedProxy.args[0] {
+			if !exists {
+				firstReplicas[replicaKey] = replica
+			}
+			result = append(result, site)
+			continue
+		}
+
+		first.generatedProxy.addArgs(replica.generatedProxy.args[1:]...)
+		first.generatedProxy.addSources(replica.generatedProxy.sources...)
+		for key, child := range replica.children {
+			if child == replica.generatedProxy {
+				delete(replica.children, key)
+			}
+		}
+		if _, err := mergeDirectives(first, replica, mergePolicy, logsBuffer); err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// mergeDirectives merges the children of site directiveB into site directiveA.
+// Sites are merged from highest priority, so directiveA priority is never lower than directiveB.
+func mergeDirectives(directiveA *directiveData, directiveB *directiveData, mergePolicy string, logsBuffer *bytes.Buffer) (*directiveData, error) {
 	if directiveA == nil {
-		return directiveB
+		return directiveB, nil
 	}
 	if directiveB == nil {
-		return directiveA
+		return directiveA, nil
 	}
 
-	for keyB, subDirectiveB := range directiveB.children {
+	for _, keyB := range getSortedKeys(directiveB.children) {
+		subDirectiveB := directiveB.children[keyB]
 		if subDirectiveA, exists := directiveA.children[keyB]; exists {
 			if subDirectiveA.name == "proxy" &&
 				subDirectiveB.name == "proxy" &&
 				len(subDirectiveA.args) > 0 &&
-				len(subDirectiveB.args) > 0 &&
-				subDirectiveA.args[0] == subDirectiveB.args[0] {
-				subDirectiveA.addArgs(subDirectiveB.args[1:]...)
-				continue
+				len(subDirectiveB.args) > 0 {
+				if subDirectiveA.args[0] == subDirectiveB.args[0] {
+					subDirectiveA.addArgs(subDirectiveB.args[1:]...)
+					subDirectiveA.addSources(subDirectiveB.sources...)
+					continue
+				}
+				// proxies of different paths don't conflict
 			} else if directivesAreSimilar(subDirectiveA, subDirectiveB) {
+				subDirectiveA.addSources(subDirectiveB.sources...)
 				continue
+			} else {
+				keep, err := resolveConflict(directiveA, directiveB, subDirectiveB, mergePolicy, logsBuffer)
+				if err != nil {
+					return nil, err
+				}
+				if !keep {
+					continue
+				}
 			}
 
-			keyB = removeSuffix(keyB) + "_" + createUniqueSuffix()
+			keyB = getFreeKey(directiveA.children, removeSuffix(keyB))
 		}
 
 		directiveA.children[keyB] = subDirectiveB
 	}
 
-	return directiveA
+	directiveA.addHosts(directiveB.hosts...)
+	directiveA.addSources(directiveB.sources...)
+
+	return directiveA, nil
+}
+
+// resolveConflict tells if a directive conflicting with an existing one in the same site is kept next to it
+func resolveConflict(directiveA *directiveData, directiveB *directiveData, subDirectiveB *directiveData, mergePolicy string, logsBuffer *bytes.Buffer) (bool, error) {
+	switch mergePolicy {
+	case mergePolicyReject:
+		return false, fmt.Errorf("Conflicting %v directive in site %v from %v and %v",
+			subDirectiveB.name, directiveA.name, strings.Join(directiveA.sources, ", "), strings.Join(directiveB.sources, ", "))
+	case mergePolicyFirst:
+	case mergePolicyPriority:
+		if directiveA.priority == directiveB.priority {
+			return true, nil
+		}
+	default:
+		return true, nil
+	}
+
+	logsBuffer.WriteString(fmt.Sprintf("[WARN] Ignoring conflicting %v directive in site %v from %v\n",
+		subDirectiveB.name, directiveA.name, strings.Join(directiveB.sources, ", ")))
+	return false, nil
 }
 
 func directivesAreSimilar(directiveA *directiveData, directiveB *directiveData) bool {
@@ -518,10 +1251,12 @@ func directivesAreSimilar(directiveA *directiveData, directiveB *directiveData)
 	return true
 }
 
-func createUniqueSuffix() string {
-	val, err := crand.Int(crand.Reader, big.NewInt(int64(math.MaxInt64)))
-	if err != nil {
-		return string(rand.Uint64())
+// getFreeKey returns the first key with a numeric suffix not used in directives
+func getFreeKey(directives map[string]*directiveData, name string) string {
+	for i := 1; ; i++ {
+		key := name + "_" + strconv.Itoa(i)
+		if _, exists := directives[key]; !exists {
+			return key
+		}
 	}
-	return string(val.Uint64())
 }
@@ -2,28 +2,97 @@ package plugin
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 
 	"github.com/docker/docker/api/types"
 )
 
 func (g *CaddyfileGenerator) getContainerDirectives(container *types.Container) (map[string]*directiveData, error) {
-	return g.parseDirectives(container.Labels, container, func() ([]string, error) {
-		return g.getContainerIPAddresses(container)
-	})
+	getProxyTargets := func(targetPort string, network string) ([]string, error) {
+		if g.targetAddress == targetAddressPublished {
+			return g.getContainerPublishedAddresses(container, targetPort)
+		}
+		ip, err := g.getContainerIPAddress(container, network)
+		if err != nil {
+			return nil, err
+		}
+		return addTargetPort([]string{ip}, targetPort), nil
+	}
+	templateContext := g.newContainerTemplateContext(container, getProxyTargets)
+	return g.parseDirectives(container.Labels, templateContext, getContainerSource(container), getProxyTargets)
+}
+
+// isContainerHealthy tells if container can be proxied according to its docker healthcheck
+func (g *CaddyfileGenerator) isContainerHealthy(container *types.Container) bool {
+	switch getContainerHealth(container) {
+	case types.Unhealthy:
+		return false
+	case types.Starting:
+		return g.includeStarting
+	}
+	return true
+}
+
+// getContainerHealth reads container health from its status, as container list doesn't have health state
+func getContainerHealth(container *types.Container) string {
+	switch {
+	case strings.Contains(container.Status, "(health: starting)"):
+		return types.Starting
+	case strings.Contains(container.Status, "(unhealthy)"):
+		return types.Unhealthy
+	case strings.Contains(container.Status, "(healthy)"):
+		return types.Healthy
+	}
+	return types.NoHealthcheck
 }
 
-func (g *CaddyfileGenerator) getContainerIPAddresses(container *types.Container) ([]string, error) {
-	ips := []string{}
+// getContainerSource describes a container as the source of directives
+func getContainerSource(container *types.Container) string {
+	name := ""
+	if len(container.Names) > 0 {
+		name = strings.TrimPrefix(container.Names[0], "/")
+	}
+	return fmt.Sprintf("container %v (%v)", name, container.ID)
+}
 
-	for _, network := range container.NetworkSettings.Networks {
-		if !g.validateNetwork || g.caddyNetworks[network.NetworkID] {
-			ips = append(ips, network.IPAddress)
+// getContainerIPAddress returns container IP in network, or in a network shared with caddy
+func (g *CaddyfileGenerator) getContainerIPAddress(container *types.Container, network string) (string, error) {
+	addresses := []networkAddress{}
+	if container.NetworkSettings != nil {
+		for name, settings := range container.NetworkSettings.Networks {
+			addresses = append(addresses, networkAddress{
+				networkID:   settings.NetworkID,
+				networkName: name,
+				address:     settings.IPAddress,
+			})
+		}
+	}
+	return g.selectNetworkAddress(fmt.Sprintf("Container %v", container.ID), addresses, network)
+}
+
+// getContainerPublishedAddresses returns the docker host addresses where target port is published
+func (g *CaddyfileGenerator) getContainerPublishedAddresses(container *types.Container, targetPort string) ([]string, error) {
+	addresses := []string{}
+
+	for _, port := range container.Ports {
+		if port.PublicPort == 0 || port.Type != "tcp" {
+			continue
+		}
+		if targetPort != "" && strconv.Itoa(int(port.PrivatePort)) != targetPort {
+			continue
+		}
+		address := g.publishedAddress
+		if port.IP != "" && port.IP != "0.0.0.0" && port.IP != "::" {
+			address = port.IP
 		}
+		addresses = append(addresses, fmt.Sprintf("%v:%v", address, port.PublicPort))
+		break
 	}
 
-	if len(ips) == 0 {
-		return ips, fmt.Errorf("Container %v and caddy are not in same network", container.ID)
+	if len(addresses) == 0 {
+		return addresses, fmt.Errorf("Container %v doesn't publish port %v", container.ID, targetPort)
 	}
 
-	return ips, nil
+	return addresses, nil
 }
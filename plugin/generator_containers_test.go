@@ -5,6 +5,7 @@ import (
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/network"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestContainers_Templates(t *testing.T) {
@@ -213,6 +214,44 @@ func TestContainers_MultipleConfigs(t *testing.T) {
 	testGeneration(t, dockerClient, false, true, expectedCaddyfile, skipCaddyfileText)
 }
 
+func TestContainers_MultipleConfigsOfSameSite(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ContainersData = []types.Container{
+		types.Container{
+			NetworkSettings: &types.SummaryNetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"caddy-network": &network.EndpointSettings{
+						IPAddress: "172.17.0.2",
+						NetworkID: caddyNetworkID,
+					},
+				},
+			},
+			Labels: map[string]string{
+				fmtLabel("%s_0.address"):    "service.testdomain.com",
+				fmtLabel("%s_0.sourcepath"): "/api",
+				fmtLabel("%s_0.targetport"): "5000",
+				fmtLabel("%s_0.header"):     "/ X-Config 0",
+				fmtLabel("%s_1.address"):    "service.testdomain.com",
+				fmtLabel("%s_1.sourcepath"): "/web",
+				fmtLabel("%s_1.targetport"): "5001",
+				fmtLabel("%s_1.header"):     "/ X-Config 1",
+			},
+		},
+	}
+
+	const expectedCaddyfile = "service.testdomain.com {\n" +
+		"  header / X-Config 0\n" +
+		"  header / X-Config 1\n" +
+		"  proxy /api 172.17.0.2:5000\n" +
+		"  proxy /web 172.17.0.2:5001\n" +
+		"}\n"
+
+	// labels are read from a map, generate many times to catch ordering changes
+	for i := 0; i < 10; i++ {
+		testGeneration(t, dockerClient, false, true, expectedCaddyfile, skipCaddyfileText)
+	}
+}
+
 func TestContainers_Replicas(t *testing.T) {
 	dockerClient := createBasicDockerClientMock()
 	dockerClient.ContainersData = []types.Container{
@@ -394,3 +433,854 @@ func TestContainers_WithSnippets(t *testing.T) {
 
 	testGeneration(t, dockerClient, false, true, expectedCaddyfile, skipCaddyfileText)
 }
+
+func TestContainers_PublishedAddress(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ContainersData = []types.Container{
+		types.Container{
+			Ports: []types.Port{
+				types.Port{IP: "0.0.0.0", PrivatePort: 80, PublicPort: 8080, Type: "tcp"},
+				types.Port{IP: "0.0.0.0", PrivatePort: 5000, PublicPort: 32768, Type: "tcp"},
+			},
+			Labels: map[string]string{
+				fmtLabel("%s.address"):    "service.testdomain.com",
+				fmtLabel("%s.targetport"): "5000",
+			},
+		},
+	}
+
+	generator := CreateGenerator(dockerClient, createDockerUtilsMock(), &GeneratorOptions{
+		labelPrefix:      defaultLabelPrefix,
+		validateNetwork:  true,
+		targetAddress:    targetAddressPublished,
+		publishedAddress: "10.0.0.2",
+	})
+
+	const expectedCaddyfile = "service.testdomain.com {\n" +
+		"  proxy / 10.0.0.2:32768\n" +
+		"}\n"
+
+	caddyfileBytes, logs, err := generator.GenerateCaddyFile()
+	assert.NoError(t, err)
+	assert.Equal(t, expectedCaddyfile, string(caddyfileBytes))
+	assert.Equal(t, skipCaddyfileText, logs)
+}
+
+func TestContainers_RejectsCaddyfileInjection(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ContainersData = []types.Container{
+		types.Container{
+			ID: "container-a",
+			NetworkSettings: &types.SummaryNetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"caddy-network": &network.EndpointSettings{
+						IPAddress: "172.17.0.2",
+						NetworkID: caddyNetworkID,
+					},
+				},
+			},
+			Labels: map[string]string{
+				fmtLabel("%s.address"): "service.testdomain.com",
+				fmtLabel("%s.tls"):     "off",
+			},
+		},
+		types.Container{
+			ID:    "container-b",
+			Names: []string{"/team-b-args"},
+			Labels: map[string]string{
+				fmtLabel("%s"):        "team-b.testdomain.com",
+				fmtLabel("%s.header"): "/ X-Test a\n}\nservice.testdomain.com {\n  proxy / attacker:80",
+			},
+		},
+		types.Container{
+			ID:    "container-c",
+			Names: []string{"/team-b-name"},
+			Labels: map[string]string{
+				fmtLabel("%s"):        "team-b.testdomain.com",
+				fmtLabel("%s.gzip }"): "",
+			},
+		},
+		types.Container{
+			ID:    "container-d",
+			Names: []string{"/team-b-import"},
+			Labels: map[string]string{
+				fmtLabel("%s"): "import",
+			},
+		},
+		types.Container{
+			ID:    "container-e",
+			Names: []string{"/team-b-import-directive"},
+			Labels: map[string]string{
+				fmtLabel("%s"):        "team-b.testdomain.com",
+				fmtLabel("%s.import"): "/etc/*",
+			},
+		},
+		types.Container{
+			ID:    "container-f",
+			Names: []string{"/team-b-nested-import"},
+			Labels: map[string]string{
+				fmtLabel("%s"):                "team-b.testdomain.com",
+				fmtLabel("%s.proxy"):          "/ backend",
+				fmtLabel("%s.proxy.import_1"): "/etc/*",
+			},
+		},
+	}
+
+	const expectedCaddyfile = "service.testdomain.com {\n" +
+		"  proxy / 172.17.0.2\n" +
+		"  tls off\n" +
+		"}\n"
+
+	const expectedLogs = skipCaddyfileText +
+		"[ERROR] Invalid label caddy.header of container team-b-args (container-b): argument } is a caddyfile block delimiter\n" +
+		"[ERROR] Invalid label caddy.gzip } of container team-b-name (container-c): directive name \"gzip }\" is not allowed\n" +
+		"[ERROR] Invalid site address import of container team-b-import (container-d)\n" +
+		"[ERROR] Invalid label caddy.import of container team-b-import-directive (container-e): directive import is not allowed\n" +
+		"[ERROR] Invalid label caddy.proxy.import_1 of container team-b-nested-import (container-f): directive import is not allowed\n"
+
+	testGeneration(t, dockerClient, false, true, expectedCaddyfile, expectedLogs)
+}
+
+func TestContainers_RejectsArgumentsThatCantBeQuoted(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ContainersData = []types.Container{
+		types.Container{
+			ID:    "container-a",
+			Names: []string{"/backslashes"},
+			NetworkSettings: &types.SummaryNetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"caddy-network": &network.EndpointSettings{
+						IPAddress: "172.17.0.2",
+						NetworkID: caddyNetworkID,
+					},
+				},
+			},
+			Labels: map[string]string{
+				fmtLabel("%s.address"): "service.testdomain.com",
+				fmtLabel("%s.header"):  `/ X-Test "a \\" "} evil.com { proxy / attacker:80 } #"`,
+			},
+		},
+		types.Container{
+			ID:    "container-b",
+			Names: []string{"/quote-after-backslash"},
+			Labels: map[string]string{
+				fmtLabel("%s.address"): "b.testdomain.com",
+				fmtLabel("%s.header"):  `/ X-Test a\"#} evil.com {`,
+			},
+		},
+		types.Container{
+			ID:    "container-c",
+			Names: []string{"/trailing-backslash"},
+			Labels: map[string]string{
+				fmtLabel("%s.address"): "c.testdomain.com",
+				fmtLabel("%s.header"):  `/ X-Test #a\`,
+			},
+		},
+	}
+
+	const expectedCaddyfile = "service.testdomain.com {\n" +
+		"  header / X-Test \"a \\\\\" \"} evil.com { proxy / attacker:80 } #\"\n" +
+		"  proxy / 172.17.0.2\n" +
+		"}\n"
+
+	const expectedLogs = skipCaddyfileText +
+		"[ERROR] Invalid label caddy.header of container quote-after-backslash (container-b): argument \"a\\\\\"#}\" can't be written to caddyfile\n" +
+		"[ERROR] Invalid label caddy.header of container trailing-backslash (container-c): argument \"#a\\\" can't be written to caddyfile\n"
+
+	testGeneration(t, dockerClient, false, true, expectedCaddyfile, expectedLogs)
+	assert.NotContains(t, lexCaddyfileArgs(expectedCaddyfile), "evil.com")
+}
+
+func TestContainers_RejectsEnvironmentPlaceholders(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ContainersData = []types.Container{
+		types.Container{
+			ID:    "container-a",
+			Names: []string{"/unix-placeholder"},
+			Labels: map[string]string{
+				fmtLabel("%s"):        "a.testdomain.com",
+				fmtLabel("%s.header"): "/ X-Leak {$DNS_TOKEN}",
+			},
+		},
+		types.Container{
+			ID:    "container-b",
+			Names: []string{"/windows-placeholder"},
+			Labels: map[string]string{
+				fmtLabel("%s"):        "b.testdomain.com",
+				fmtLabel("%s.header"): `/ X-Leak "token {%DNS_TOKEN%}"`,
+			},
+		},
+		types.Container{
+			ID:    "container-c",
+			Names: []string{"/site-placeholder"},
+			Labels: map[string]string{
+				fmtLabel("%s"): "{$DNS_TOKEN}.testdomain.com",
+			},
+		},
+		types.Container{
+			ID:    "container-d",
+			Names: []string{"/name-placeholder"},
+			Labels: map[string]string{
+				fmtLabel("%s"):              "d.testdomain.com",
+				fmtLabel("%s.{$DNS_TOKEN}"): "",
+			},
+		},
+	}
+
+	const expectedLogs = skipCaddyfileText +
+		"[ERROR] Invalid label caddy.header of container unix-placeholder (container-a): argument {$DNS_TOKEN} has a caddyfile environment variable placeholder\n" +
+		"[ERROR] Invalid label caddy.header of container windows-placeholder (container-b): argument \"token {%DNS_TOKEN%}\" has a caddyfile environment variable placeholder\n" +
+		"[ERROR] Invalid label caddy of container site-placeholder (container-c): argument {$DNS_TOKEN}.testdomain.com has a caddyfile environment variable placeholder\n" +
+		"[ERROR] Invalid label caddy.{$DNS_TOKEN} of container name-placeholder (container-d): directive name {$DNS_TOKEN} is not allowed\n"
+
+	testGeneration(t, dockerClient, false, true, "", expectedLogs)
+}
+
+func TestContainers_ComposeReplicas(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ContainersData = []types.Container{
+		types.Container{
+			ID: "container-c",
+			NetworkSettings: &types.SummaryNetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"caddy-network": &network.EndpointSettings{
+						IPAddress: "172.17.0.4",
+						NetworkID: caddyNetworkID,
+					},
+				},
+			},
+			Labels: map[string]string{
+				"com.docker.compose.project":          "shop",
+				"com.docker.compose.service":          "web",
+				"com.docker.compose.container-number": "3",
+				fmtLabel("%s.address"):                "service.testdomain.com",
+				fmtLabel("%s.lbpolicy"):               "round_robin",
+				fmtLabel("%s.healthcheck"):            "/health",
+			},
+		},
+		types.Container{
+			ID: "container-a",
+			NetworkSettings: &types.SummaryNetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"caddy-network": &network.EndpointSettings{
+						IPAddress: "172.17.0.2",
+						NetworkID: caddyNetworkID,
+					},
+				},
+			},
+			Labels: map[string]string{
+				"com.docker.compose.project":          "shop",
+				"com.docker.compose.service":          "web",
+				"com.docker.compose.container-number": "1",
+				fmtLabel("%s.address"):                "service.testdomain.com",
+				fmtLabel("%s.lbpolicy"):               "round_robin",
+				fmtLabel("%s.healthcheck"):            "/health",
+			},
+		},
+		types.Container{
+			ID: "container-b",
+			NetworkSettings: &types.SummaryNetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"caddy-network": &network.EndpointSettings{
+						IPAddress: "172.17.0.3",
+						NetworkID: caddyNetworkID,
+					},
+				},
+			},
+			Labels: map[string]string{
+				"com.docker.compose.project":          "shop",
+				"com.docker.compose.service":          "web",
+				"com.docker.compose.container-number": "2",
+				fmtLabel("%s.address"):                "service.testdomain.com",
+				fmtLabel("%s.lbpolicy"):               "round_robin",
+				fmtLabel("%s.healthcheck"):            "/health",
+			},
+		},
+		types.Container{
+			ID: "container-d",
+			NetworkSettings: &types.SummaryNetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"caddy-network": &network.EndpointSettings{
+						IPAddress: "172.17.0.5",
+						NetworkID: caddyNetworkID,
+					},
+				},
+			},
+			Labels: map[string]string{
+				"com.docker.compose.project":          "shop",
+				"com.docker.compose.service":          "admin",
+				"com.docker.compose.container-number": "1",
+				fmtLabel("%s.address"):                "service.testdomain.com",
+				fmtLabel("%s.lbpolicy"):               "round_robin",
+				fmtLabel("%s.healthcheck"):            "/health",
+				fmtLabel("%s.sourcepath"):             "/admin",
+			},
+		},
+	}
+
+	const expectedCaddyfile = "service.testdomain.com {\n" +
+		"  proxy / 172.17.0.2 172.17.0.3 172.17.0.4 {\n" +
+		"    health_check /health\n" +
+		"    policy round_robin\n" +
+		"  }\n" +
+		"  proxy /admin 172.17.0.5 {\n" +
+		"    health_check /health\n" +
+		"    policy round_robin\n" +
+		"  }\n" +
+		"}\n"
+
+	testGeneration(t, dockerClient, false, true, expectedCaddyfile, skipCaddyfileText)
+}
+
+func TestContainers_ReplicasGroupedByLabel(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ContainersData = []types.Container{
+		types.Container{
+			ID: "container-a",
+			NetworkSettings: &types.SummaryNetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"caddy-network": &network.EndpointSettings{
+						IPAddress: "172.17.0.2",
+						NetworkID: caddyNetworkID,
+					},
+				},
+			},
+			Labels: map[string]string{
+				"com.docker.compose.project":          "shop",
+				"com.docker.compose.service":          "blue",
+				"com.docker.compose.container-number": "1",
+				fmtLabel("%s.address"):                "service.testdomain.com",
+				fmtLabel("%s.lbpolicy"):               "round_robin",
+				fmtLabel("%s.healthcheck"):            "/health",
+				fmtLabel("%s.group"):                  "web",
+			},
+		},
+		types.Container{
+			ID: "container-b",
+			NetworkSettings: &types.SummaryNetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"caddy-network": &network.EndpointSettings{
+						IPAddress: "172.17.0.3",
+						NetworkID: caddyNetworkID,
+					},
+				},
+			},
+			Labels: map[string]string{
+				"com.docker.compose.project":          "shop",
+				"com.docker.compose.service":          "green",
+				"com.docker.compose.container-number": "1",
+				fmtLabel("%s.address"):                "service.testdomain.com",
+				fmtLabel("%s.lbpolicy"):               "round_robin",
+				fmtLabel("%s.healthcheck"):            "/health",
+				fmtLabel("%s.group"):                  "web",
+			},
+		},
+	}
+
+	const expectedCaddyfile = "service.testdomain.com {\n" +
+		"  proxy / 172.17.0.2 172.17.0.3 {\n" +
+		"    health_check /health\n" +
+		"    policy round_robin\n" +
+		"  }\n" +
+		"}\n"
+
+	testGeneration(t, dockerClient, false, true, expectedCaddyfile, skipCaddyfileText)
+}
+
+func TestContainers_ReplicasMergeOtherDirectivesWithPolicy(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ContainersData = []types.Container{
+		types.Container{
+			ID:    "container-a",
+			Names: []string{"/web-1"},
+			NetworkSettings: &types.SummaryNetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"caddy-network": &network.EndpointSettings{
+						IPAddress: "172.17.0.2",
+						NetworkID: caddyNetworkID,
+					},
+				},
+			},
+			Labels: map[string]string{
+				"com.docker.compose.project":          "shop",
+				"com.docker.compose.service":          "web",
+				"com.docker.compose.container-number": "1",
+				fmtLabel("%s.address"):                "service.testdomain.com",
+				fmtLabel("%s.header"):                 "/ X-Replica {{.Slot}}",
+				fmtLabel("%s.gzip"):                   "",
+			},
+		},
+		types.Container{
+			ID:    "container-b",
+			Names: []string{"/web-2"},
+			NetworkSettings: &types.SummaryNetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"caddy-network": &network.EndpointSettings{
+						IPAddress: "172.17.0.3",
+						NetworkID: caddyNetworkID,
+					},
+				},
+			},
+			Labels: map[string]string{
+				"com.docker.compose.project":          "shop",
+				"com.docker.compose.service":          "web",
+				"com.docker.compose.container-number": "2",
+				fmtLabel("%s.address"):                "service.testdomain.com",
+				fmtLabel("%s.header"):                 "/ X-Replica {{.Slot}}",
+				fmtLabel("%s.gzip"):                   "",
+			},
+		},
+	}
+
+	const expectedCaddyfile = "service.testdomain.com {\n" +
+		"  gzip\n" +
+		"  header / X-Replica 1\n" +
+		"  proxy / 172.17.0.2 172.17.0.3\n" +
+		"}\n"
+
+	const expectedLogs = skipCaddyfileText +
+		"[WARN] Ignoring conflicting header directive in site service.testdomain.com from container web-2 (container-b)\n"
+
+	testGenerationWithOptions(t, dockerClient, createDockerUtilsMock(), &GeneratorOptions{
+		labelPrefix:     defaultLabelPrefix,
+		validateNetwork: true,
+		mergePolicy:     mergePolicyFirst,
+	}, expectedCaddyfile, expectedLogs)
+}
+
+func TestContainers_SkipsUnhealthyReplicas(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ContainersData = []types.Container{
+		types.Container{
+			ID:     "container-a",
+			Names:  []string{"/web-1"},
+			Status: "Up 1 minute (healthy)",
+			NetworkSettings: &types.SummaryNetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"caddy-network": &network.EndpointSettings{
+						IPAddress: "172.17.0.2",
+						NetworkID: caddyNetworkID,
+					},
+				},
+			},
+			Labels: map[string]string{
+				"com.docker.compose.project":          "shop",
+				"com.docker.compose.service":          "web",
+				"com.docker.compose.container-number": "1",
+				fmtLabel("%s.address"):                "service.testdomain.com",
+			},
+		},
+		types.Container{
+			ID:     "container-b",
+			Names:  []string{"/web-2"},
+			Status: "Up 1 minute (unhealthy)",
+			NetworkSettings: &types.SummaryNetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"caddy-network": &network.EndpointSettings{
+						IPAddress: "172.17.0.3",
+						NetworkID: caddyNetworkID,
+					},
+				},
+			},
+			Labels: map[string]string{
+				"com.docker.compose.project":          "shop",
+				"com.docker.compose.service":          "web",
+				"com.docker.compose.container-number": "2",
+				fmtLabel("%s.address"):                "service.testdomain.com",
+			},
+		},
+		types.Container{
+			ID:     "container-c",
+			Names:  []string{"/web-3"},
+			Status: "Up 1 minute (health: starting)",
+			NetworkSettings: &types.SummaryNetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"caddy-network": &network.EndpointSettings{
+						IPAddress: "172.17.0.4",
+						NetworkID: caddyNetworkID,
+					},
+				},
+			},
+			Labels: map[string]string{
+				"com.docker.compose.project":          "shop",
+				"com.docker.compose.service":          "web",
+				"com.docker.compose.container-number": "3",
+				fmtLabel("%s.address"):                "service.testdomain.com",
+			},
+		},
+	}
+
+	const expectedCaddyfile = "service.testdomain.com {\n" +
+		"  proxy / 172.17.0.2\n" +
+		"}\n"
+
+	const expectedLogs = skipCaddyfileText +
+		"[INFO] Skipping site service.testdomain.com of unhealthy container web-2 (container-b)\n" +
+		"[INFO] Skipping site service.testdomain.com of unhealthy container web-3 (container-c)\n"
+
+	testGeneration(t, dockerClient, false, true, expectedCaddyfile, expectedLogs)
+}
+
+func TestContainers_IncludesStartingReplicas(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ContainersData = []types.Container{
+		types.Container{
+			ID:     "container-a",
+			Names:  []string{"/web-1"},
+			Status: "Up 1 minute (healthy)",
+			NetworkSettings: &types.SummaryNetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"caddy-network": &network.EndpointSettings{
+						IPAddress: "172.17.0.2",
+						NetworkID: caddyNetworkID,
+					},
+				},
+			},
+			Labels: map[string]string{
+				"com.docker.compose.project":          "shop",
+				"com.docker.compose.service":          "web",
+				"com.docker.compose.container-number": "1",
+				fmtLabel("%s.address"):                "service.testdomain.com",
+			},
+		},
+		types.Container{
+			ID:     "container-b",
+			Names:  []string{"/web-2"},
+			Status: "Up 1 minute (unhealthy)",
+			NetworkSettings: &types.SummaryNetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"caddy-network": &network.EndpointSettings{
+						IPAddress: "172.17.0.3",
+						NetworkID: caddyNetworkID,
+					},
+				},
+			},
+			Labels: map[string]string{
+				"com.docker.compose.project":          "shop",
+				"com.docker.compose.service":          "web",
+				"com.docker.compose.container-number": "2",
+				fmtLabel("%s.address"):                "service.testdomain.com",
+			},
+		},
+		types.Container{
+			ID:     "container-c",
+			Names:  []string{"/web-3"},
+			Status: "Up 1 minute (health: starting)",
+			NetworkSettings: &types.SummaryNetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"caddy-network": &network.EndpointSettings{
+						IPAddress: "172.17.0.4",
+						NetworkID: caddyNetworkID,
+					},
+				},
+			},
+			Labels: map[string]string{
+				"com.docker.compose.project":          "shop",
+				"com.docker.compose.service":          "web",
+				"com.docker.compose.container-number": "3",
+				fmtLabel("%s.address"):                "service.testdomain.com",
+			},
+		},
+	}
+
+	const expectedCaddyfile = "service.testdomain.com {\n" +
+		"  proxy / 172.17.0.2 172.17.0.4\n" +
+		"}\n"
+
+	const expectedLogs = skipCaddyfileText +
+		"[INFO] Skipping site service.testdomain.com of unhealthy container web-2 (container-b)\n"
+
+	testGenerationWithOptions(t, dockerClient, createDockerUtilsMock(), &GeneratorOptions{
+		labelPrefix:     defaultLabelPrefix,
+		validateNetwork: true,
+		includeStarting: true,
+	}, expectedCaddyfile, expectedLogs)
+}
+
+func TestContainers_UnhealthyFallback(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ContainersData = []types.Container{
+		types.Container{
+			ID:     "container-a",
+			Names:  []string{"/web-1"},
+			Status: "Up 1 minute (unhealthy)",
+			NetworkSettings: &types.SummaryNetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"caddy-network": &network.EndpointSettings{
+						IPAddress: "172.17.0.2",
+						NetworkID: caddyNetworkID,
+					},
+				},
+			},
+			Labels: map[string]string{
+				"com.docker.compose.project":          "shop",
+				"com.docker.compose.service":          "web",
+				"com.docker.compose.container-number": "1",
+				fmtLabel("%s.address"):                "service.testdomain.com",
+			},
+		},
+		types.Container{
+			ID:     "container-b",
+			Names:  []string{"/web-2"},
+			Status: "Up 1 minute (health: starting)",
+			NetworkSettings: &types.SummaryNetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"caddy-network": &network.EndpointSettings{
+						IPAddress: "172.17.0.3",
+						NetworkID: caddyNetworkID,
+					},
+				},
+			},
+			Labels: map[string]string{
+				"com.docker.compose.project":          "shop",
+				"com.docker.compose.service":          "web",
+				"com.docker.compose.container-number": "2",
+				fmtLabel("%s.address"):                "service.testdomain.com",
+			},
+		},
+	}
+
+	const expectedCaddyfile = "service.testdomain.com {\n" +
+		"  proxy / 172.17.0.2 172.17.0.3\n" +
+		"}\n"
+
+	const expectedLogs = skipCaddyfileText +
+		"[WARN] Proxying site service.testdomain.com to unhealthy container web-1 (container-a) because no replica is healthy\n" +
+		"[WARN] Proxying site service.testdomain.com to unhealthy container web-2 (container-b) because no replica is healthy\n"
+
+	testGenerationWithOptions(t, dockerClient, createDockerUtilsMock(), &GeneratorOptions{
+		labelPrefix:       defaultLabelPrefix,
+		validateNetwork:   true,
+		unhealthyFallback: unhealthyFallbackAll,
+	}, expectedCaddyfile, expectedLogs)
+
+	const expectedNoneLogs = skipCaddyfileText +
+		"[INFO] Skipping site service.testdomain.com of unhealthy container web-1 (container-a)\n" +
+		"[INFO] Skipping site service.testdomain.com of unhealthy container web-2 (container-b)\n"
+
+	testGenerationWithOptions(t, dockerClient, createDockerUtilsMock(), &GeneratorOptions{
+		labelPrefix:       defaultLabelPrefix,
+		validateNetwork:   true,
+		unhealthyFallback: unhealthyFallbackNone,
+	}, "", expectedNoneLogs)
+}
+
+func TestContainers_SharedNetworksPickOneAddress(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ContainerInspectData[caddyContainerID].NetworkSettings.Networks["backend"] = &network.EndpointSettings{
+		NetworkID: "backend-network-id",
+	}
+	dockerClient.ContainersData = []types.Container{
+		types.Container{
+			ID: "container-a",
+			NetworkSettings: &types.SummaryNetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"caddy-network": &network.EndpointSettings{
+						IPAddress: "172.17.0.2",
+						NetworkID: caddyNetworkID,
+					},
+					"backend": &network.EndpointSettings{
+						IPAddress: "10.1.0.2",
+						NetworkID: "backend-network-id",
+					},
+					"other-network": &network.EndpointSettings{
+						IPAddress: "10.0.0.1",
+						NetworkID: "other-network-id",
+					},
+				},
+			},
+			Labels: map[string]string{
+				fmtLabel("%s.address"): "service.testdomain.com",
+			},
+		},
+	}
+
+	// without preference, networks are sorted by name
+	const expectedCaddyfile = "service.testdomain.com {\n" +
+		"  proxy / 10.1.0.2\n" +
+		"}\n"
+
+	testGeneration(t, dockerClient, false, true, expectedCaddyfile, skipCaddyfileText)
+}
+
+func TestContainers_NetworkLabel(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ContainerInspectData[caddyContainerID].NetworkSettings.Networks["backend"] = &network.EndpointSettings{
+		NetworkID: "backend-network-id",
+	}
+	dockerClient.ContainersData = []types.Container{
+		types.Container{
+			ID: "container-a",
+			NetworkSettings: &types.SummaryNetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"caddy-network": &network.EndpointSettings{
+						IPAddress: "172.17.0.2",
+						NetworkID: caddyNetworkID,
+					},
+					"backend": &network.EndpointSettings{
+						IPAddress: "10.1.0.2",
+						NetworkID: "backend-network-id",
+					},
+					"other-network": &network.EndpointSettings{
+						IPAddress: "10.0.0.1",
+						NetworkID: "other-network-id",
+					},
+				},
+			},
+			Labels: map[string]string{
+				fmtLabel("%s.address"): "a.testdomain.com",
+				fmtLabel("%s.network"): "caddy-network",
+			},
+		},
+		types.Container{
+			ID: "container-b",
+			NetworkSettings: &types.SummaryNetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"caddy-network": &network.EndpointSettings{
+						IPAddress: "172.17.0.3",
+						NetworkID: caddyNetworkID,
+					},
+					"backend": &network.EndpointSettings{
+						IPAddress: "10.1.0.3",
+						NetworkID: "backend-network-id",
+					},
+					"other-network": &network.EndpointSettings{
+						IPAddress: "10.0.0.1",
+						NetworkID: "other-network-id",
+					},
+				},
+			},
+			Labels: map[string]string{
+				fmtLabel("%s.address"): "b.testdomain.com",
+				fmtLabel("%s.network"): caddyNetworkID,
+			},
+		},
+	}
+
+	// network label wins over preferred network
+	const expectedCaddyfile = "a.testdomain.com {\n" +
+		"  proxy / 172.17.0.2\n" +
+		"}\n" +
+		"b.testdomain.com {\n" +
+		"  proxy / 172.17.0.3\n" +
+		"}\n"
+
+	testGenerationWithOptions(t, dockerClient, createDockerUtilsMock(), &GeneratorOptions{
+		labelPrefix:      defaultLabelPrefix,
+		validateNetwork:  true,
+		preferredNetwork: "backend",
+	}, expectedCaddyfile, skipCaddyfileText)
+}
+
+func TestContainers_NetworkLabelErrors(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ContainerInspectData[caddyContainerID].NetworkSettings.Networks["backend"] = &network.EndpointSettings{
+		NetworkID: "backend-network-id",
+	}
+	dockerClient.ContainersData = []types.Container{
+		types.Container{
+			ID: "container-a",
+			NetworkSettings: &types.SummaryNetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"caddy-network": &network.EndpointSettings{
+						IPAddress: "172.17.0.2",
+						NetworkID: caddyNetworkID,
+					},
+					"backend": &network.EndpointSettings{
+						IPAddress: "10.1.0.2",
+						NetworkID: "backend-network-id",
+					},
+					"other-network": &network.EndpointSettings{
+						IPAddress: "10.0.0.1",
+						NetworkID: "other-network-id",
+					},
+				},
+			},
+			Labels: map[string]string{
+				fmtLabel("%s.address"): "a.testdomain.com",
+				fmtLabel("%s.network"): "other-network",
+			},
+		},
+		types.Container{
+			ID: "container-b",
+			NetworkSettings: &types.SummaryNetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"caddy-network": &network.EndpointSettings{
+						IPAddress: "172.17.0.3",
+						NetworkID: caddyNetworkID,
+					},
+					"backend": &network.EndpointSettings{
+						IPAddress: "10.1.0.3",
+						NetworkID: "backend-network-id",
+					},
+					"other-network": &network.EndpointSettings{
+						IPAddress: "10.0.0.1",
+						NetworkID: "other-network-id",
+					},
+				},
+			},
+			Labels: map[string]string{
+				fmtLabel("%s.address"): "b.testdomain.com",
+				fmtLabel("%s.network"): "missing-network",
+			},
+		},
+	}
+
+	const expectedLogs = skipCaddyfileText +
+		"[ERROR] Container container-a network other-network isn't shared with caddy\n" +
+		"[ERROR] Container container-b isn't attached to network missing-network\n"
+
+	testGeneration(t, dockerClient, false, true, "", expectedLogs)
+}
+
+func TestContainers_PreferredNetwork(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ContainerInspectData[caddyContainerID].NetworkSettings.Networks["backend"] = &network.EndpointSettings{
+		NetworkID: "backend-network-id",
+	}
+	dockerClient.ContainersData = []types.Container{
+		types.Container{
+			ID: "container-a",
+			NetworkSettings: &types.SummaryNetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"caddy-network": &network.EndpointSettings{
+						IPAddress: "172.17.0.2",
+						NetworkID: caddyNetworkID,
+					},
+					"backend": &network.EndpointSettings{
+						IPAddress: "10.1.0.2",
+						NetworkID: "backend-network-id",
+					},
+					"other-network": &network.EndpointSettings{
+						IPAddress: "10.0.0.1",
+						NetworkID: "other-network-id",
+					},
+				},
+			},
+			Labels: map[string]string{
+				fmtLabel("%s.address"): "service.testdomain.com",
+			},
+		},
+	}
+
+	const expectedCaddyfile = "service.testdomain.com {\n" +
+		"  proxy / 172.17.0.2\n" +
+		"}\n"
+
+	testGenerationWithOptions(t, dockerClient, createDockerUtilsMock(), &GeneratorOptions{
+		labelPrefix:      defaultLabelPrefix,
+		validateNetwork:  true,
+		preferredNetwork: "caddy-network",
+	}, expectedCaddyfile, skipCaddyfileText)
+
+	// preferred network is ignored when not shared with container
+	const expectedSortedCaddyfile = "service.testdomain.com {\n" +
+		"  proxy / 10.1.0.2\n" +
+		"}\n"
+
+	testGenerationWithOptions(t, dockerClient, createDockerUtilsMock(), &GeneratorOptions{
+		labelPrefix:      defaultLabelPrefix,
+		validateNetwork:  true,
+		preferredNetwork: "missing-network",
+	}, expectedSortedCaddyfile, skipCaddyfileText)
+}
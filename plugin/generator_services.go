@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"strconv"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/filters"
@@ -11,41 +12,112 @@ import (
 )
 
 func (g *CaddyfileGenerator) getServiceDirectives(service *swarm.Service) (map[string]*directiveData, error) {
-	return g.parseDirectives(service.Spec.Labels, service, func() ([]string, error) {
-		return g.getServiceProxyTargets(service)
-	})
+	getProxyTargets := func(targetPort string, network string) ([]string, error) {
+		return g.getServiceProxyTargets(service, targetPort, network)
+	}
+	templateContext := g.newServiceTemplateContext(service, getProxyTargets)
+	return g.parseDirectives(service.Spec.Labels, templateContext, getServiceSource(service), getProxyTargets)
+}
+
+// getServiceSource describes a service as the source of directives
+func getServiceSource(service *swarm.Service) string {
+	return fmt.Sprintf("service %v (%v)", service.Spec.Name, service.ID)
 }
 
-func (g *CaddyfileGenerator) getServiceProxyTargets(service *swarm.Service) ([]string, error) {
-	if g.proxyServiceTasks {
-		return g.getServiceTasksIps(service)
+func (g *CaddyfileGenerator) getServiceProxyTargets(service *swarm.Service, targetPort string, network string) ([]string, error) {
+	if g.targetAddress == targetAddressPublished {
+		return g.getServicePublishedAddresses(service, targetPort)
+	}
+
+	dnsrr := isDNSRRService(service)
+	// docker dns names of services can't be resolved by caddy running outside containers
+	hostMode := g.isHostMode()
+
+	if dnsrr && g.dnsrrTargets == dnsrrTargetsDNS && !hostMode {
+		if err := g.validateServiceNetworks(service); err != nil {
+			return nil, err
+		}
+		// docker dns resolves tasks.<service> to the IPs of all service tasks
+		return addTargetPort([]string{"tasks." + service.Spec.Name}, targetPort), nil
 	}
 
-	_, err := g.getServiceVirtualIps(service)
+	if g.proxyServiceTasks || dnsrr {
+		tasksIps, err := g.getServiceTasksIps(service, network)
+		if err != nil {
+			return nil, err
+		}
+		return addTargetPort(tasksIps, targetPort), nil
+	}
+
+	virtualIP, err := g.getServiceVirtualIP(service, network)
 	if err != nil {
 		return nil, err
 	}
 
-	return []string{service.Spec.Name}, nil
-}
+	if hostMode {
+		ipAddress, _, err := net.ParseCIDR(virtualIP)
+		if err != nil {
+			return nil, fmt.Errorf("Service %v has invalid virtual IP %v", service.ID, virtualIP)
+		}
+		return addTargetPort([]string{ipAddress.String()}, targetPort), nil
+	}
 
-func (g *CaddyfileGenerator) getServiceVirtualIps(service *swarm.Service) ([]string, error) {
-	virtualIps := []string{}
+	return addTargetPort([]string{service.Spec.Name}, targetPort), nil
+}
 
-	for _, virtualIP := range service.Endpoint.VirtualIPs {
-		if !g.validateNetwork || g.caddyNetworks[virtualIP.NetworkID] {
-			virtualIps = append(virtualIps, virtualIP.Addr)
+// getServicePublishedAddresses returns the swarm routing mesh address where target port is published
+func (g *CaddyfileGenerator) getServicePublishedAddresses(service *swarm.Service, targetPort string) ([]string, error) {
+	for _, port := range service.Endpoint.Ports {
+		if port.PublishedPort == 0 || port.Protocol != swarm.PortConfigProtocolTCP {
+			continue
 		}
+		if targetPort != "" && strconv.Itoa(int(port.TargetPort)) != targetPort {
+			continue
+		}
+		return []string{fmt.Sprintf("%v:%v", g.publishedAddress, port.PublishedPort)}, nil
 	}
 
-	if len(virtualIps) == 0 {
-		return []string{}, fmt.Errorf("Service %v and caddy are not in same network", service.ID)
+	return []string{}, fmt.Errorf("Service %v doesn't publish port %v", service.ID, targetPort)
+}
+
+// isDNSRRService tells if service uses dns round robin instead of a virtual IP
+func isDNSRRService(service *swarm.Service) bool {
+	if service.Endpoint.Spec.Mode != "" {
+		return service.Endpoint.Spec.Mode == swarm.ResolutionModeDNSRR
+	}
+	return service.Spec.EndpointSpec != nil && service.Spec.EndpointSpec.Mode == swarm.ResolutionModeDNSRR
+}
+
+// validateServiceNetworks checks if service tasks are attached to a network caddy can reach
+func (g *CaddyfileGenerator) validateServiceNetworks(service *swarm.Service) error {
+	if !g.validateNetwork {
+		return nil
+	}
+	for _, network := range service.Spec.TaskTemplate.Networks {
+		if g.canReach(networkAddress{networkID: network.Target}) {
+			return nil
+		}
 	}
+	return fmt.Errorf("Service %v and caddy are not in same network", service.ID)
+}
 
-	return virtualIps, nil
+// getServiceVirtualIP returns service virtual IP in network, or in a network shared with caddy
+func (g *CaddyfileGenerator) getServiceVirtualIP(service *swarm.Service, network string) (string, error) {
+	addresses := []networkAddress{}
+	for _, virtualIP := range service.Endpoint.VirtualIPs {
+		address := networkAddress{networkID: virtualIP.NetworkID, address: virtualIP.Addr}
+		// virtual IPs only have network ID, names are only needed to match a network
+		if network != "" || g.preferredNetwork != "" {
+			if networkInfo, err := g.dockerClient.NetworkInspect(context.Background(), virtualIP.NetworkID, types.NetworkInspectOptions{}); err == nil {
+				address.networkName = networkInfo.Name
+			}
+		}
+		addresses = append(addresses, address)
+	}
+	return g.selectNetworkAddress(fmt.Sprintf("Service %v", service.ID), addresses, network)
 }
 
-func (g *CaddyfileGenerator) getServiceTasksIps(service *swarm.Service) ([]string, error) {
+func (g *CaddyfileGenerator) getServiceTasksIps(service *swarm.Service, network string) ([]string, error) {
 	taskListFilter := filters.NewArgs()
 	taskListFilter.Add("service", service.ID)
 	taskListFilter.Add("desired-state", "running")
@@ -57,17 +129,29 @@ func (g *CaddyfileGenerator) getServiceTasksIps(service *swarm.Service) ([]strin
 
 	hasRunningTasks := false
 	tasksIps := []string{}
+	var networkErr error
 	for _, task := range tasks {
 		if task.Status.State == swarm.TaskStateRunning {
 			hasRunningTasks = true
+			addresses := []networkAddress{}
 			for _, networkAttachment := range task.NetworksAttachments {
-				if !g.validateNetwork || g.caddyNetworks[networkAttachment.Network.ID] {
-					for _, address := range networkAttachment.Addresses {
-						ipAddress, _, _ := net.ParseCIDR(address)
-						tasksIps = append(tasksIps, ipAddress.String())
-					}
+				if len(networkAttachment.Addresses) == 0 {
+					continue
 				}
+				ipAddress, _, _ := net.ParseCIDR(networkAttachment.Addresses[0])
+				addresses = append(addresses, networkAddress{
+					networkID:   networkAttachment.Network.ID,
+					networkName: networkAttachment.Network.Spec.Name,
+					address:     ipAddress.String(),
+				})
+			}
+			// tasks being moved between networks are skipped, as long as other tasks are reachable
+			taskIP, err := g.selectNetworkAddress(fmt.Sprintf("Service %v", service.ID), addresses, network)
+			if err != nil {
+				networkErr = err
+				continue
 			}
+			tasksIps = append(tasksIps, taskIP)
 		}
 	}
 
@@ -76,7 +160,7 @@ func (g *CaddyfileGenerator) getServiceTasksIps(service *swarm.Service) ([]strin
 	}
 
 	if len(tasksIps) == 0 {
-		return []string{}, fmt.Errorf("Service %v and caddy are not in same network", service.ID)
+		return []string{}, networkErr
 	}
 
 	return tasksIps, nil
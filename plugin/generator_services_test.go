@@ -1,10 +1,13 @@
 package plugin
 
 import (
+	"fmt"
 	"testing"
 
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/api/types/swarm"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestServices_Templates(t *testing.T) {
@@ -583,3 +586,119 @@ func TestServiceTasks_Running(t *testing.T) {
 
 	testGeneration(t, dockerClient, true, true, expectedCaddyfile, skipCaddyfileText)
 }
+
+func TestServices_DNSRRProxiesToTasks(t *testing.T) {
+	dockerClient := createDNSRRDockerClientMock()
+
+	const expectedCaddyfile = "service.testdomain.com {\n" +
+		"  proxy / 10.0.0.1:5000 10.0.0.2:5000\n" +
+		"}\n"
+
+	testGeneration(t, dockerClient, false, true, expectedCaddyfile, skipCaddyfileText)
+}
+
+func TestServices_DNSRRProxiesToTasksDNS(t *testing.T) {
+	dockerClient := createDNSRRDockerClientMock()
+
+	generator := CreateGenerator(dockerClient, createDockerUtilsMock(), &GeneratorOptions{
+		labelPrefix:     defaultLabelPrefix,
+		validateNetwork: true,
+		dnsrrTargets:    dnsrrTargetsDNS,
+	})
+
+	const expectedCaddyfile = "service.testdomain.com {\n" +
+		"  proxy / tasks.service:5000\n" +
+		"}\n"
+
+	caddyfileBytes, logs, err := generator.GenerateCaddyFile()
+	assert.NoError(t, err)
+	assert.Equal(t, expectedCaddyfile, string(caddyfileBytes))
+	assert.Equal(t, skipCaddyfileText, logs)
+}
+
+func TestServices_DNSRRDifferentNetwork(t *testing.T) {
+	dockerClient := createDNSRRDockerClientMock()
+	dockerClient.ServicesData[0].Spec.TaskTemplate.Networks[0].Target = "other-network-id"
+
+	generator := CreateGenerator(dockerClient, createDockerUtilsMock(), &GeneratorOptions{
+		labelPrefix:     defaultLabelPrefix,
+		validateNetwork: true,
+		dnsrrTargets:    dnsrrTargetsDNS,
+	})
+
+	const expectedLogs = skipCaddyfileText +
+		"[ERROR] Service SERVICEID and caddy are not in same network\n"
+
+	caddyfileBytes, logs, err := generator.GenerateCaddyFile()
+	assert.NoError(t, err)
+	assert.Equal(t, "", string(caddyfileBytes))
+	assert.Equal(t, expectedLogs, logs)
+}
+
+func createDNSRRDockerClientMock() *dockerClientMock {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ServicesData = []swarm.Service{
+		swarm.Service{
+			ID: "SERVICEID",
+			Spec: swarm.ServiceSpec{
+				Annotations: swarm.Annotations{
+					Name: "service",
+					Labels: map[string]string{
+						fmtLabel("%s.address"):    "service.testdomain.com",
+						fmtLabel("%s.targetport"): "5000",
+					},
+				},
+				TaskTemplate: swarm.TaskSpec{
+					Networks: []swarm.NetworkAttachmentConfig{
+						swarm.NetworkAttachmentConfig{
+							Target: caddyNetworkID,
+						},
+					},
+				},
+				EndpointSpec: &swarm.EndpointSpec{
+					Mode: swarm.ResolutionModeDNSRR,
+				},
+			},
+		},
+	}
+	for i, address := range []string{"10.0.0.1/24", "10.0.0.2/24"} {
+		dockerClient.TasksData = append(dockerClient.TasksData, swarm.Task{
+			ID:        fmt.Sprintf("TASKID%v", i),
+			ServiceID: "SERVICEID",
+			NetworksAttachments: []swarm.NetworkAttachment{
+				swarm.NetworkAttachment{
+					Network: swarm.Network{
+						ID: caddyNetworkID,
+					},
+					Addresses: []string{address},
+				},
+			},
+			DesiredState: swarm.TaskStateRunning,
+			Status:       swarm.TaskStatus{State: swarm.TaskStateRunning},
+		})
+	}
+	return dockerClient
+}
+
+func TestServiceTasks_NetworkLabel(t *testing.T) {
+	dockerClient := createDNSRRDockerClientMock()
+	dockerClient.ServicesData[0].Spec.Labels[fmtLabel("%s.network")] = "backend"
+	dockerClient.ContainerInspectData[caddyContainerID].NetworkSettings.Networks["backend"] = &network.EndpointSettings{
+		NetworkID: "backend-network-id",
+	}
+	for i := range dockerClient.TasksData {
+		dockerClient.TasksData[i].NetworksAttachments = append(dockerClient.TasksData[i].NetworksAttachments, swarm.NetworkAttachment{
+			Network: swarm.Network{
+				ID:   "backend-network-id",
+				Spec: swarm.NetworkSpec{Annotations: swarm.Annotations{Name: "backend"}},
+			},
+			Addresses: []string{fmt.Sprintf("10.1.0.%v/24", i+1)},
+		})
+	}
+
+	const expectedCaddyfile = "service.testdomain.com {\n" +
+		"  proxy / 10.1.0.1:5000 10.1.0.2:5000\n" +
+		"}\n"
+
+	testGeneration(t, dockerClient, true, true, expectedCaddyfile, skipCaddyfileText)
+}
@@ -5,9 +5,13 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"strings"
+	"sync"
 	"testing"
 
+	"github.com/caddyserver/caddy/caddyfile"
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
 	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/api/types/swarm"
 	"github.com/stretchr/testify/assert"
@@ -120,6 +124,403 @@ func TestIgnoreLabelsWithoutCaddyPrefix(t *testing.T) {
 	testGeneration(t, dockerClient, true, true, expectedCaddyfile, skipCaddyfileText)
 }
 
+func TestParseArgs(t *testing.T) {
+	assert.Equal(t, []string{}, parseArgs(""))
+	assert.Equal(t, []string{"/", "service:5000"}, parseArgs(" /  service:5000 "))
+	assert.Equal(t, []string{"/", "X-Test", "a b"}, parseArgs(`/ X-Test "a b"`))
+	assert.Equal(t, []string{"user", `pass "word"`}, parseArgs(`user "pass \"word\""`))
+	assert.Equal(t, []string{`a\\b`, `c\d`}, parseArgs(`"a\\b" "c\d"`))
+	assert.Equal(t, []string{"", `a"b"`}, parseArgs(`"" a"b"`))
+	assert.Equal(t, []string{"unterminated quote"}, parseArgs(`"unterminated quote`))
+}
+
+func TestParseArgsRoundTripsBackslashes(t *testing.T) {
+	tests := []struct {
+		label    string
+		expected []string
+	}{
+		{`"a\\b"`, []string{`a\\b`}},
+		{`"c\d"`, []string{`c\d`}},
+		{`a\b "c d\"`, []string{`a\b`, `c d"`}},
+		{`"a \\" b`, []string{`a \\`, "b"}},
+		{`"pass \"word\""`, []string{`pass "word"`}},
+		{`"x\\\"y"`, []string{`x\\"y`}},
+		{`"x\\\\ y"`, []string{`x\\\\ y`}},
+	}
+
+	for _, test := range tests {
+		args := parseArgs(test.label)
+		assert.Equal(t, test.expected, args, test.label)
+
+		quotedArgs := []string{}
+		for _, arg := range args {
+			quotedArgs = append(quotedArgs, quoteArg(arg))
+		}
+		assert.Equal(t, args, lexCaddyfileArgs(strings.Join(quotedArgs, " ")), test.label)
+	}
+}
+
+// lexCaddyfileArgs splits a caddyfile line into tokens with caddy lexer
+func lexCaddyfileArgs(line string) []string {
+	tokens := []string{}
+	dispenser := caddyfile.NewDispenser("test", strings.NewReader(line))
+	for dispenser.Next() {
+		tokens = append(tokens, dispenser.Val())
+	}
+	return tokens
+}
+
+func TestQuotesArgs(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ContainersData = []types.Container{
+		types.Container{
+			Labels: map[string]string{
+				fmtLabel("%s"):           "service.testdomain.com",
+				fmtLabel("%s.header"):    `/ Content-Security-Policy "default-src 'self'; img-src *"`,
+				fmtLabel("%s.basicauth"): `/ user "pass \"word\" #1"`,
+			},
+		},
+	}
+
+	const expectedCaddyfile = "service.testdomain.com {\n" +
+		"  basicauth / user \"pass \\\"word\\\" #1\"\n" +
+		"  header / Content-Security-Policy \"default-src 'self'; img-src *\"\n" +
+		"}\n"
+
+	testGeneration(t, dockerClient, false, true, expectedCaddyfile, skipCaddyfileText)
+}
+
+func TestMergesDirectivesFromMultipleHosts(t *testing.T) {
+	dockerClientA := createBasicDockerClientMock()
+	dockerClientA.ContainersData = []types.Container{
+		types.Container{
+			NetworkSettings: &types.SummaryNetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"caddy-network": &network.EndpointSettings{
+						IPAddress: "172.17.0.2",
+						NetworkID: caddyNetworkID,
+					},
+				},
+			},
+			Labels: map[string]string{
+				fmtLabel("%s.address"): "service.testdomain.com",
+			},
+		},
+	}
+
+	dockerClientB := createBasicDockerClientMock()
+	dockerClientB.ContainersData = []types.Container{
+		types.Container{
+			Ports: []types.Port{
+				types.Port{PrivatePort: 80, PublicPort: 32768, Type: "tcp"},
+			},
+			Labels: map[string]string{
+				fmtLabel("%s.address"): "service.testdomain.com",
+			},
+		},
+	}
+
+	// host-c is unreachable, so its cache was never synced
+	dockerClientC := createBasicDockerClientMock()
+	dockerClientC.InfoError = fmt.Errorf("Cannot connect to the Docker daemon")
+	cacheC := newDockerCache(dockerClientC)
+	assert.Error(t, cacheC.Resync(context.Background()))
+
+	dockerUtils := createDockerUtilsMock()
+	generators := []*CaddyfileGenerator{
+		CreateGenerator(dockerClientA, dockerUtils, &GeneratorOptions{
+			labelPrefix:     defaultLabelPrefix,
+			validateNetwork: true,
+			hostName:        "host-a",
+			targetAddress:   targetAddressNetwork,
+		}),
+		CreateGenerator(dockerClientB, dockerUtils, &GeneratorOptions{
+			labelPrefix:      defaultLabelPrefix,
+			hostName:         "host-b",
+			targetAddress:    targetAddressPublished,
+			publishedAddress: "10.0.0.3",
+		}),
+		CreateGenerator(cacheC, dockerUtils, &GeneratorOptions{
+			labelPrefix:      defaultLabelPrefix,
+			hostName:         "host-c",
+			targetAddress:    targetAddressPublished,
+			publishedAddress: "10.0.0.4",
+		}),
+	}
+
+	const expectedCaddyfile = "# docker hosts: host-a, host-b\n" +
+		"service.testdomain.com {\n" +
+		"  proxy / 172.17.0.2 10.0.0.3:32768\n" +
+		"}\n"
+
+	caddyfileBytes, _, logs, err := generateCaddyfile(&GeneratorOptions{}, generators)
+	assert.NoError(t, err)
+	assert.Equal(t, expectedCaddyfile, string(caddyfileBytes))
+	assert.Contains(t, logs, "[ERROR] Host host-c: Cannot connect to the Docker daemon\n")
+}
+
+func TestSingleHostIsOnlyCommentedWithSourceComments(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ContainersData = []types.Container{
+		types.Container{
+			ID:    "container-a",
+			Names: []string{"/service-a"},
+			NetworkSettings: &types.SummaryNetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"caddy-network": &network.EndpointSettings{
+						IPAddress: "172.17.0.2",
+						NetworkID: caddyNetworkID,
+					},
+				},
+			},
+			Labels: map[string]string{
+				fmtLabel("%s.address"): "service.testdomain.com",
+			},
+		},
+	}
+
+	const expectedCaddyfile = "service.testdomain.com {\n" +
+		"  proxy / 172.17.0.2\n" +
+		"}\n"
+
+	testGenerationWithOptions(t, dockerClient, createDockerUtilsMock(), &GeneratorOptions{
+		labelPrefix:     defaultLabelPrefix,
+		validateNetwork: true,
+		hostName:        "host-a",
+	}, expectedCaddyfile, skipCaddyfileText)
+
+	const expectedCommentedCaddyfile = "# docker hosts: host-a\n" +
+		"# source: container service-a (container-a)\n" +
+		"service.testdomain.com {\n" +
+		"  proxy / 172.17.0.2\n" +
+		"}\n"
+
+	testGenerationWithOptions(t, dockerClient, createDockerUtilsMock(), &GeneratorOptions{
+		labelPrefix:     defaultLabelPrefix,
+		validateNetwork: true,
+		hostName:        "host-a",
+		sourceComments:  true,
+	}, expectedCommentedCaddyfile, skipCaddyfileText)
+}
+
+func TestMergeIsDeterministic(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ContainersData = []types.Container{
+		types.Container{
+			ID:    "container-b",
+			Names: []string{"/service-b"},
+			Labels: map[string]string{
+				fmtLabel("%s"):        "service.testdomain.com",
+				fmtLabel("%s.header"): "/ X-Source b",
+			},
+		},
+		types.Container{
+			ID:    "container-a",
+			Names: []string{"/service-a"},
+			Labels: map[string]string{
+				fmtLabel("%s"):        "service.testdomain.com",
+				fmtLabel("%s.header"): "/ X-Source a",
+			},
+		},
+		types.Container{
+			ID:    "container-c",
+			Names: []string{"/service-c"},
+			Labels: map[string]string{
+				fmtLabel("%s"):        "service.testdomain.com",
+				fmtLabel("%s.header"): "/ X-Source c",
+			},
+		},
+	}
+
+	options := &GeneratorOptions{
+		labelPrefix:     defaultLabelPrefix,
+		validateNetwork: true,
+		mergePolicy:     mergePolicyMerge,
+	}
+
+	const expectedCaddyfile = "service.testdomain.com {\n" +
+		"  header / X-Source a\n" +
+		"  header / X-Source b\n" +
+		"  header / X-Source c\n" +
+		"}\n"
+
+	testGenerationWithOptions(t, dockerClient, createDockerUtilsMock(), options, expectedCaddyfile, skipCaddyfileText)
+
+	containers := dockerClient.ContainersData
+	containers[0], containers[2] = containers[2], containers[0]
+	testGenerationWithOptions(t, dockerClient, createDockerUtilsMock(), options, expectedCaddyfile, skipCaddyfileText)
+}
+
+func TestMergePolicyFirst(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ContainersData = []types.Container{
+		types.Container{
+			ID:    "container-b",
+			Names: []string{"/service-b"},
+			Labels: map[string]string{
+				fmtLabel("%s"):        "service.testdomain.com",
+				fmtLabel("%s.header"): "/ X-Source b",
+			},
+		},
+		types.Container{
+			ID:    "container-a",
+			Names: []string{"/service-a"},
+			Labels: map[string]string{
+				fmtLabel("%s"):        "service.testdomain.com",
+				fmtLabel("%s.header"): "/ X-Source a",
+			},
+		},
+	}
+
+	const expectedCaddyfile = "service.testdomain.com {\n" +
+		"  header / X-Source a\n" +
+		"}\n"
+
+	const expectedLogs = skipCaddyfileText +
+		"[WARN] Ignoring conflicting header directive in site service.testdomain.com from container service-b (container-b)\n"
+
+	testGenerationWithOptions(t, dockerClient, createDockerUtilsMock(), &GeneratorOptions{
+		labelPrefix:     defaultLabelPrefix,
+		validateNetwork: true,
+		mergePolicy:     mergePolicyFirst,
+	}, expectedCaddyfile, expectedLogs)
+}
+
+func TestMergePolicyPriority(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ContainersData = []types.Container{
+		types.Container{
+			ID:    "container-a",
+			Names: []string{"/service-a"},
+			Labels: map[string]string{
+				fmtLabel("%s"):        "service.testdomain.com",
+				fmtLabel("%s.header"): "/ X-Source a",
+			},
+		},
+		types.Container{
+			ID:    "container-b",
+			Names: []string{"/service-b"},
+			Labels: map[string]string{
+				fmtLabel("%s"):          "service.testdomain.com",
+				fmtLabel("%s.header"):   "/ X-Source b",
+				fmtLabel("%s.priority"): "10",
+			},
+		},
+		types.Container{
+			ID:    "container-c",
+			Names: []string{"/service-c"},
+			Labels: map[string]string{
+				fmtLabel("%s"):          "service.testdomain.com",
+				fmtLabel("%s.header"):   "/ X-Source c",
+				fmtLabel("%s.priority"): "10",
+			},
+		},
+	}
+
+	const expectedCaddyfile = "service.testdomain.com {\n" +
+		"  header / X-Source b\n" +
+		"  header / X-Source c\n" +
+		"}\n"
+
+	const expectedLogs = skipCaddyfileText +
+		"[WARN] Ignoring conflicting header directive in site service.testdomain.com from container service-a (container-a)\n"
+
+	testGenerationWithOptions(t, dockerClient, createDockerUtilsMock(), &GeneratorOptions{
+		labelPrefix:     defaultLabelPrefix,
+		validateNetwork: true,
+		mergePolicy:     mergePolicyPriority,
+	}, expectedCaddyfile, expectedLogs)
+}
+
+func TestMergePolicyReject(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ContainersData = []types.Container{
+		types.Container{
+			ID:    "container-a",
+			Names: []string{"/service-a"},
+			Labels: map[string]string{
+				fmtLabel("%s"):        "service.testdomain.com",
+				fmtLabel("%s.header"): "/ X-Source a",
+			},
+		},
+		types.Container{
+			ID:    "container-b",
+			Names: []string{"/service-b"},
+			Labels: map[string]string{
+				fmtLabel("%s"):        "service.testdomain.com",
+				fmtLabel("%s.header"): "/ X-Source b",
+			},
+		},
+	}
+
+	generator := CreateGenerator(dockerClient, createDockerUtilsMock(), &GeneratorOptions{
+		labelPrefix:     defaultLabelPrefix,
+		validateNetwork: true,
+		mergePolicy:     mergePolicyReject,
+	})
+
+	_, _, err := generator.GenerateCaddyFile()
+	assert.EqualError(t, err, "Conflicting header directive in site service.testdomain.com from container service-a (container-a) and container service-b (container-b)")
+}
+
+func TestSourceComments(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ContainersData = []types.Container{
+		types.Container{
+			ID:    "container-b",
+			Names: []string{"/service-b"},
+			Labels: map[string]string{
+				fmtLabel("%s"):        "service.testdomain.com",
+				fmtLabel("%s.header"): "/ X-Source b",
+				fmtLabel("%s.gzip"):   "",
+			},
+		},
+		types.Container{
+			ID:    "container-a",
+			Names: []string{"/service-a"},
+			Labels: map[string]string{
+				fmtLabel("%s"):        "service.testdomain.com",
+				fmtLabel("%s.header"): "/ X-Source a",
+				fmtLabel("%s.gzip"):   "",
+			},
+		},
+	}
+	dockerClient.ConfigsData = []swarm.Config{
+		swarm.Config{
+			ID: "CONFIG-ID",
+			Spec: swarm.ConfigSpec{
+				Annotations: swarm.Annotations{
+					Name: "example",
+					Labels: map[string]string{
+						fmtLabel("%s"): "",
+					},
+				},
+				Data: []byte("example.com {\n  tls off\n}"),
+			},
+		},
+	}
+
+	const expectedCaddyfile = "# source: config example (CONFIG-ID)\n" +
+		"example.com {\n" +
+		"  tls off\n" +
+		"}\n" +
+		"# end of source: config example (CONFIG-ID)\n" +
+		"# source: container service-a (container-a), container service-b (container-b)\n" +
+		"service.testdomain.com {\n" +
+		"  gzip\n" +
+		"  # source: container service-a (container-a)\n" +
+		"  header / X-Source a\n" +
+		"  # source: container service-b (container-b)\n" +
+		"  header / X-Source b\n" +
+		"}\n"
+
+	testGenerationWithOptions(t, dockerClient, createDockerUtilsMock(), &GeneratorOptions{
+		labelPrefix:     defaultLabelPrefix,
+		validateNetwork: true,
+		sourceComments:  true,
+	}, expectedCaddyfile, skipCaddyfileText)
+}
+
 func testGeneration(
 	t *testing.T,
 	dockerClient DockerClient,
@@ -128,15 +529,26 @@ func testGeneration(
 	expectedCaddyfile string,
 	expectedLogs string,
 ) {
-	dockerUtils := createDockerUtilsMock()
-
-	generator := CreateGenerator(dockerClient, dockerUtils, &GeneratorOptions{
+	testGenerationWithOptions(t, dockerClient, createDockerUtilsMock(), &GeneratorOptions{
 		labelPrefix:       defaultLabelPrefix,
 		proxyServiceTasks: proxyServiceTasks,
 		validateNetwork:   validateNetwork,
-	})
+	}, expectedCaddyfile, expectedLogs)
+}
 
-	caddyfileBytes, logs := generator.GenerateCaddyFile()
+// testGenerationWithOptions checks generation with options other than the ones of testGeneration
+func testGenerationWithOptions(
+	t *testing.T,
+	dockerClient DockerClient,
+	dockerUtils DockerUtils,
+	options *GeneratorOptions,
+	expectedCaddyfile string,
+	expectedLogs string,
+) {
+	generator := CreateGenerator(dockerClient, dockerUtils, options)
+
+	caddyfileBytes, logs, err := generator.GenerateCaddyFile()
+	assert.NoError(t, err)
 	assert.Equal(t, expectedCaddyfile, string(caddyfileBytes))
 	assert.Equal(t, expectedLogs, logs)
 }
@@ -185,19 +597,55 @@ type dockerClientMock struct {
 	ConfigsData          []swarm.Config
 	TasksData            []swarm.Task
 	InfoData             types.Info
+	InfoError            error
 	ContainerInspectData map[string]types.ContainerJSON
 	NetworkInspectData   map[string]types.NetworkResource
+	MockEvents           func(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error)
+	MockPing             func(ctx context.Context) (types.Ping, error)
+	NetworkConnectError  error
+	callsMutex           sync.Mutex
+	calls                map[string]int
+}
+
+func (mock *dockerClientMock) countCall(method string) {
+	mock.callsMutex.Lock()
+	defer mock.callsMutex.Unlock()
+	if mock.calls == nil {
+		mock.calls = map[string]int{}
+	}
+	mock.calls[method]++
+}
+
+func (mock *dockerClientMock) CallCount(method string) int {
+	mock.callsMutex.Lock()
+	defer mock.callsMutex.Unlock()
+	return mock.calls[method]
 }
 
 func (mock *dockerClientMock) ContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
-	return mock.ContainersData, nil
+	mock.countCall("ContainerList")
+	matchingContainers := []types.Container{}
+	for _, container := range mock.ContainersData {
+		if options.Filters.Match("id", container.ID) {
+			matchingContainers = append(matchingContainers, container)
+		}
+	}
+	return matchingContainers, nil
 }
 
 func (mock *dockerClientMock) ServiceList(ctx context.Context, options types.ServiceListOptions) ([]swarm.Service, error) {
-	return mock.ServicesData, nil
+	mock.countCall("ServiceList")
+	matchingServices := []swarm.Service{}
+	for _, service := range mock.ServicesData {
+		if options.Filters.Match("id", service.ID) {
+			matchingServices = append(matchingServices, service)
+		}
+	}
+	return matchingServices, nil
 }
 
 func (mock *dockerClientMock) TaskList(ctx context.Context, options types.TaskListOptions) ([]swarm.Task, error) {
+	mock.countCall("TaskList")
 	matchingTasks := []swarm.Task{}
 	for _, task := range mock.TasksData {
 		if !options.Filters.Match("service", task.ServiceID) {
@@ -212,7 +660,8 @@ func (mock *dockerClientMock) TaskList(ctx context.Context, options types.TaskLi
 }
 
 func (mock *dockerClientMock) Info(ctx context.Context) (types.Info, error) {
-	return mock.InfoData, nil
+	mock.countCall("Info")
+	return mock.InfoData, mock.InfoError
 }
 
 func (mock *dockerClientMock) ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error) {
@@ -223,11 +672,50 @@ func (mock *dockerClientMock) NetworkInspect(ctx context.Context, networkID stri
 	return mock.NetworkInspectData[networkID], nil
 }
 
+func (mock *dockerClientMock) NetworkList(ctx context.Context, options types.NetworkListOptions) ([]types.NetworkResource, error) {
+	mock.countCall("NetworkList")
+	matchingNetworks := []types.NetworkResource{}
+	for id, network := range mock.NetworkInspectData {
+		network.ID = id
+		if options.Filters.Match("id", network.ID) {
+			matchingNetworks = append(matchingNetworks, network)
+		}
+	}
+	return matchingNetworks, nil
+}
+
+// NetworkConnect attaches container to network in inspect data
+func (mock *dockerClientMock) NetworkConnect(ctx context.Context, networkID, containerID string, config *network.EndpointSettings) error {
+	mock.countCall("NetworkConnect")
+	if mock.NetworkConnectError != nil {
+		return mock.NetworkConnectError
+	}
+	container := mock.ContainerInspectData[containerID]
+	container.NetworkSettings.Networks[mock.NetworkInspectData[networkID].Name] = &network.EndpointSettings{
+		NetworkID: networkID,
+	}
+	return nil
+}
+
+// NetworkDisconnect detaches container from network in inspect data
+func (mock *dockerClientMock) NetworkDisconnect(ctx context.Context, networkID, containerID string, force bool) error {
+	mock.countCall("NetworkDisconnect")
+	container := mock.ContainerInspectData[containerID]
+	for name, settings := range container.NetworkSettings.Networks {
+		if settings.NetworkID == networkID {
+			delete(container.NetworkSettings.Networks, name)
+		}
+	}
+	return nil
+}
+
 func (mock *dockerClientMock) ConfigList(ctx context.Context, options types.ConfigListOptions) ([]swarm.Config, error) {
+	mock.countCall("ConfigList")
 	return mock.ConfigsData, nil
 }
 
 func (mock *dockerClientMock) ConfigInspectWithRaw(ctx context.Context, id string) (swarm.Config, []byte, error) {
+	mock.countCall("ConfigInspectWithRaw")
 	for _, config := range mock.ConfigsData {
 		if config.ID == id {
 			return config, nil, nil
@@ -236,6 +724,20 @@ func (mock *dockerClientMock) ConfigInspectWithRaw(ctx context.Context, id strin
 	return swarm.Config{}, nil, nil
 }
 
+func (mock *dockerClientMock) Ping(ctx context.Context) (types.Ping, error) {
+	if mock.MockPing != nil {
+		return mock.MockPing(ctx)
+	}
+	return types.Ping{}, nil
+}
+
+func (mock *dockerClientMock) Events(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error) {
+	if mock.MockEvents != nil {
+		return mock.MockEvents(ctx, options)
+	}
+	return make(chan events.Message), make(chan error)
+}
+
 type dockerUtilsMock struct {
 	MockGetCurrentContainerID func() (string, error)
 }
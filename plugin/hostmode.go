@@ -0,0 +1,78 @@
+package plugin
+
+import (
+	"context"
+	"log"
+	"net"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+)
+
+// isHostMode tells if caddy runs outside a container, reaching the networks configured by operator
+func (g *CaddyfileGenerator) isHostMode() bool {
+	return len(g.hostNetworks) > 0 || len(g.hostCIDRs) > 0
+}
+
+// getHostNetworks returns networks matching host networks patterns, or with subnets inside host CIDRs
+func (g *CaddyfileGenerator) getHostNetworks() ([]string, error) {
+	networks, err := g.dockerClient.NetworkList(context.Background(), types.NetworkListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	result := []string{}
+	for _, network := range networks {
+		if !network.Ingress && g.isHostNetwork(network) {
+			result = append(result, network.ID)
+		}
+	}
+	sort.Strings(result)
+	log.Printf("[INFO] Caddy Networks: %v\n", result)
+
+	return result, nil
+}
+
+func (g *CaddyfileGenerator) isHostNetwork(network types.NetworkResource) bool {
+	for _, pattern := range g.hostNetworks {
+		if pattern == network.ID {
+			return true
+		}
+		if matches, _ := path.Match(pattern, network.Name); matches {
+			return true
+		}
+	}
+	for _, config := range network.IPAM.Config {
+		_, subnet, err := net.ParseCIDR(config.Subnet)
+		if err != nil {
+			continue
+		}
+		subnetOnes, _ := subnet.Mask.Size()
+		for _, cidr := range g.hostCIDRs {
+			cidrOnes, _ := cidr.Mask.Size()
+			if cidr.Contains(subnet.IP) && subnetOnes >= cidrOnes {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseCIDRs parses CIDRs separated by spaces or commas, skipping invalid ones
+func parseCIDRs(text string) []*net.IPNet {
+	cidrs := []*net.IPNet{}
+	for _, item := range eventPatternsSeparator.Split(strings.TrimSpace(text), -1) {
+		if item == "" {
+			continue
+		}
+		_, cidr, err := net.ParseCIDR(item)
+		if err != nil {
+			log.Printf("[ERROR] Invalid CIDR %v: %v", item, err)
+			continue
+		}
+		cidrs = append(cidrs, cidr)
+	}
+	return cidrs
+}
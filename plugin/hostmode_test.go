@@ -0,0 +1,255 @@
+package plugin
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHostMode_ReachesNetworksByName(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.NetworkInspectData["frontend-network-id"] = types.NetworkResource{
+		Name: "frontend",
+		IPAM: network.IPAM{Config: []network.IPAMConfig{{Subnet: "10.3.0.0/24"}}},
+	}
+	dockerClient.NetworkInspectData["backend-network-id"] = types.NetworkResource{
+		Name: "backend",
+		IPAM: network.IPAM{Config: []network.IPAMConfig{{Subnet: "10.4.0.0/24"}}},
+	}
+	dockerClient.ContainersData = []types.Container{
+		types.Container{
+			ID: "container-a",
+			NetworkSettings: &types.SummaryNetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"frontend": &network.EndpointSettings{
+						IPAddress: "10.3.0.2",
+						NetworkID: "frontend-network-id",
+					},
+				},
+			},
+			Labels: map[string]string{
+				fmtLabel("%s.address"): "a.testdomain.com",
+			},
+		},
+		types.Container{
+			ID: "container-b",
+			NetworkSettings: &types.SummaryNetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"backend": &network.EndpointSettings{
+						IPAddress: "10.4.0.2",
+						NetworkID: "backend-network-id",
+					},
+				},
+			},
+			Labels: map[string]string{
+				fmtLabel("%s.address"): "b.testdomain.com",
+			},
+		},
+	}
+
+	// caddy isn't running in a container
+	dockerUtils := &dockerUtilsMock{
+		MockGetCurrentContainerID: func() (string, error) {
+			return "", fmt.Errorf("Cannot find container id")
+		},
+	}
+
+	const expectedCaddyfile = "a.testdomain.com {\n" +
+		"  proxy / 10.3.0.2\n" +
+		"}\n"
+
+	const expectedLogs = skipCaddyfileText +
+		"[ERROR] Container container-b and caddy are not in same network\n"
+
+	testGenerationWithOptions(t, dockerClient, dockerUtils, &GeneratorOptions{
+		labelPrefix:     defaultLabelPrefix,
+		validateNetwork: true,
+		hostNetworks:    parseNetworkPatterns("front*"),
+	}, expectedCaddyfile, expectedLogs)
+}
+
+func TestHostMode_ReachesCIDRs(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.NetworkInspectData["frontend-network-id"] = types.NetworkResource{
+		Name: "frontend",
+		IPAM: network.IPAM{Config: []network.IPAMConfig{{Subnet: "10.3.0.0/24"}}},
+	}
+	dockerClient.NetworkInspectData["backend-network-id"] = types.NetworkResource{
+		Name: "backend",
+		IPAM: network.IPAM{Config: []network.IPAMConfig{{Subnet: "10.4.0.0/24"}}},
+	}
+	// macvlan network without subnet, reached by target addresses
+	dockerClient.NetworkInspectData["lan-network-id"] = types.NetworkResource{
+		Name: "lan",
+	}
+	dockerClient.ContainersData = []types.Container{
+		types.Container{
+			ID: "container-a",
+			NetworkSettings: &types.SummaryNetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"frontend": &network.EndpointSettings{
+						IPAddress: "10.3.0.2",
+						NetworkID: "frontend-network-id",
+					},
+				},
+			},
+			Labels: map[string]string{
+				fmtLabel("%s.address"): "a.testdomain.com",
+			},
+		},
+		types.Container{
+			ID: "container-b",
+			NetworkSettings: &types.SummaryNetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"backend": &network.EndpointSettings{
+						IPAddress: "10.4.0.2",
+						NetworkID: "backend-network-id",
+					},
+				},
+			},
+			Labels: map[string]string{
+				fmtLabel("%s.address"): "b.testdomain.com",
+			},
+		},
+		types.Container{
+			ID: "container-c",
+			NetworkSettings: &types.SummaryNetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"lan": &network.EndpointSettings{
+						IPAddress: "192.168.1.20",
+						NetworkID: "lan-network-id",
+					},
+				},
+			},
+			Labels: map[string]string{
+				fmtLabel("%s.address"): "c.testdomain.com",
+			},
+		},
+	}
+
+	// caddy isn't running in a container
+	dockerUtils := &dockerUtilsMock{
+		MockGetCurrentContainerID: func() (string, error) {
+			return "", fmt.Errorf("Cannot find container id")
+		},
+	}
+
+	const expectedCaddyfile = "b.testdomain.com {\n" +
+		"  proxy / 10.4.0.2\n" +
+		"}\n" +
+		"c.testdomain.com {\n" +
+		"  proxy / 192.168.1.20\n" +
+		"}\n"
+
+	const expectedLogs = skipCaddyfileText +
+		"[ERROR] Container container-a and caddy are not in same network\n"
+
+	testGenerationWithOptions(t, dockerClient, dockerUtils, &GeneratorOptions{
+		labelPrefix:     defaultLabelPrefix,
+		validateNetwork: true,
+		hostCIDRs:       parseCIDRs("10.4.0.0/16, 192.168.1.0/24"),
+	}, expectedCaddyfile, expectedLogs)
+}
+
+func TestHostMode_ProxiesServicesToIPs(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.NetworkInspectData["frontend-network-id"] = types.NetworkResource{
+		Name: "frontend",
+		IPAM: network.IPAM{Config: []network.IPAMConfig{{Subnet: "10.3.0.0/24"}}},
+	}
+	dockerClient.NetworkInspectData["backend-network-id"] = types.NetworkResource{
+		Name: "backend",
+		IPAM: network.IPAM{Config: []network.IPAMConfig{{Subnet: "10.4.0.0/24"}}},
+	}
+	dockerClient.ServicesData = []swarm.Service{
+		swarm.Service{
+			ID: "VIPSERVICEID",
+			Spec: swarm.ServiceSpec{
+				Annotations: swarm.Annotations{
+					Name: "api",
+					Labels: map[string]string{
+						fmtLabel("%s.address"):    "a.testdomain.com",
+						fmtLabel("%s.targetport"): "8080",
+					},
+				},
+			},
+			Endpoint: swarm.Endpoint{
+				VirtualIPs: []swarm.EndpointVirtualIP{
+					swarm.EndpointVirtualIP{
+						NetworkID: "backend-network-id",
+						Addr:      "10.4.0.5/24",
+					},
+				},
+			},
+		},
+		swarm.Service{
+			ID: "DNSRRSERVICEID",
+			Spec: swarm.ServiceSpec{
+				Annotations: swarm.Annotations{
+					Name: "db",
+					Labels: map[string]string{
+						fmtLabel("%s.address"): "b.testdomain.com",
+					},
+				},
+				TaskTemplate: swarm.TaskSpec{
+					Networks: []swarm.NetworkAttachmentConfig{
+						swarm.NetworkAttachmentConfig{
+							Target: "backend-network-id",
+						},
+					},
+				},
+				EndpointSpec: &swarm.EndpointSpec{
+					Mode: swarm.ResolutionModeDNSRR,
+				},
+			},
+		},
+	}
+	dockerClient.TasksData = []swarm.Task{
+		swarm.Task{
+			ServiceID: "DNSRRSERVICEID",
+			NetworksAttachments: []swarm.NetworkAttachment{
+				swarm.NetworkAttachment{
+					Network: swarm.Network{
+						ID: "backend-network-id",
+					},
+					Addresses: []string{"10.4.0.7/24"},
+				},
+			},
+			DesiredState: swarm.TaskStateRunning,
+			Status:       swarm.TaskStatus{State: swarm.TaskStateRunning},
+		},
+	}
+
+	// caddy isn't running in a container
+	dockerUtils := &dockerUtilsMock{
+		MockGetCurrentContainerID: func() (string, error) {
+			return "", fmt.Errorf("Cannot find container id")
+		},
+	}
+
+	const expectedCaddyfile = "a.testdomain.com {\n" +
+		"  proxy / 10.4.0.5:8080\n" +
+		"}\n" +
+		"b.testdomain.com {\n" +
+		"  proxy / 10.4.0.7\n" +
+		"}\n"
+
+	testGenerationWithOptions(t, dockerClient, dockerUtils, &GeneratorOptions{
+		labelPrefix:     defaultLabelPrefix,
+		validateNetwork: true,
+		// docker dns can't be used outside containers, even when configured
+		dnsrrTargets: dnsrrTargetsDNS,
+		hostNetworks: parseNetworkPatterns("back*"),
+	}, expectedCaddyfile, skipCaddyfileText)
+}
+
+func TestHostMode_ParsesCIDRs(t *testing.T) {
+	cidrs := parseCIDRs("10.0.0.0/8 invalid,192.168.1.0/24")
+	assert.Len(t, cidrs, 2)
+	assert.Equal(t, "10.0.0.0/8", cidrs[0].String())
+	assert.Equal(t, "192.168.1.0/24", cidrs[1].String())
+}
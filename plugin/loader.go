@@ -6,38 +6,180 @@ import (
 	"flag"
 	"log"
 	"os"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/caddyserver/caddy"
-	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
 	"github.com/docker/docker/api/types/filters"
-	"github.com/docker/docker/client"
 )
 
-var pollingInterval = 30 * time.Second
+var defaultPollingInterval = 30 * time.Second
+var defaultEventsDebounce = 100 * time.Millisecond
+var defaultEventsMaxWait = 1 * time.Second
+
+var pollingIntervalFlag time.Duration
 var processCaddyfileFlag bool
+var eventsDebounceFlag time.Duration
+var eventsMaxWaitFlag time.Duration
+var eventsFlag string
+var stateFileFlag string
+var adminAddressFlag string
 
 func init() {
-	flag.DurationVar(&pollingInterval, "docker-polling-interval", 30*time.Second, "Interval caddy should manually check docker for a new caddyfile")
+	flag.DurationVar(&pollingIntervalFlag, "docker-polling-interval", defaultPollingInterval, "Interval caddy should manually check docker for a new caddyfile")
 	flag.BoolVar(&processCaddyfileFlag, "docker-process-caddyfile", false, "Process caddyfile, removing invalid servers")
+	flag.DurationVar(&eventsDebounceFlag, "docker-events-debounce", defaultEventsDebounce, "Time without docker events to wait before updating caddyfile")
+	flag.DurationVar(&eventsMaxWaitFlag, "docker-events-max-wait", defaultEventsMaxWait, "Maximum time to delay a caddyfile update while docker events keep arriving")
+	flag.StringVar(&eventsFlag, "docker-events", "default", "Docker events that trigger caddyfile updates, as type:action patterns")
+	flag.StringVar(&stateFileFlag, "docker-state-file", "", "Path to save last valid caddyfile, served on startup while docker is unreachable")
+	flag.StringVar(&adminAddressFlag, "docker-admin-address", "", "Address to serve read-only admin HTTP API and prometheus metrics, like 127.0.0.1:2020")
+}
+
+// LoaderOptions are the options for docker loader
+type LoaderOptions struct {
+	pollingInterval  time.Duration
+	processCaddyfile bool
+	eventsDebounce   time.Duration
+	eventsMaxWait    time.Duration
+	events           *eventMatcher
+	stateFile        string
+	adminAddress     string
+}
+
+// GetLoaderOptions creates loader options from cli flags and environment variables
+func GetLoaderOptions() *LoaderOptions {
+	options := LoaderOptions{}
+
+	if processCaddyfileEnv := os.Getenv("CADDY_DOCKER_PROCESS_CADDYFILE"); processCaddyfileEnv != "" {
+		options.processCaddyfile = isTrue.MatchString(processCaddyfileEnv)
+	} else {
+		options.processCaddyfile = processCaddyfileFlag
+	}
+
+	options.pollingInterval = getDurationOption("CADDY_DOCKER_POLLING_INTERVAL", pollingIntervalFlag)
+	options.eventsDebounce = getDurationOption("CADDY_DOCKER_EVENTS_DEBOUNCE", eventsDebounceFlag)
+	options.eventsMaxWait = getDurationOption("CADDY_DOCKER_EVENTS_MAX_WAIT", eventsMaxWaitFlag)
+
+	events := eventsFlag
+	if eventsEnv := os.Getenv("CADDY_DOCKER_EVENTS"); eventsEnv != "" {
+		events = eventsEnv
+	}
+	matcher, err := parseEventMatcher(events)
+	if err != nil {
+		log.Printf("Failed to parse docker events: %v", err)
+		matcher, _ = parseEventMatcher("default")
+	}
+	options.events = matcher
+
+	if stateFileEnv := os.Getenv("CADDY_DOCKER_STATE_FILE"); stateFileEnv != "" {
+		options.stateFile = stateFileEnv
+	} else {
+		options.stateFile = stateFileFlag
+	}
+
+	if adminAddressEnv := os.Getenv("CADDY_DOCKER_ADMIN_ADDRESS"); adminAddressEnv != "" {
+		options.adminAddress = adminAddressEnv
+	} else {
+		options.adminAddress = adminAddressFlag
+	}
+
+	return &options
+}
+
+func getDurationOption(envName string, flagValue time.Duration) time.Duration {
+	if env := os.Getenv(envName); env != "" {
+		if d, err := time.ParseDuration(env); err != nil {
+			log.Printf("Failed to parse %v: %v", envName, err)
+		} else {
+			return d
+		}
+	}
+	return flagValue
 }
 
 // DockerLoader generates caddy files from docker swarm information
 type DockerLoader struct {
-	initialized       bool
-	dockerClient      *client.Client
-	generator         *CaddyfileGenerator
-	timer             *time.Timer
-	skipEvents        bool
-	input             caddy.CaddyfileInput
-	processCaddyfile  bool
+	initOnce         sync.Once
+	options          *LoaderOptions
+	generatorOptions *GeneratorOptions
+	endpoints        []*dockerEndpoint
+	reloadCaddy      func(input caddy.Input) error
+	requests         chan reconcileRequest
+	inputMutex       sync.RWMutex
+	input            caddy.CaddyfileInput
+	statusMutex      sync.RWMutex
+	reloadStatus     ReloadStatus
+	generation       generationStatus
+
+	// Fields below are owned by reconcile goroutine
+	pendingSince      time.Time
 	previousCaddyfile []byte
 	previousLogs      string
 }
 
+// ReloadStatus is the result of the last caddy reload
+type ReloadStatus struct {
+	// Time of the last reload, zero when caddy was never reloaded
+	Time time.Time `json:"time"`
+	// Error of the last reload, empty when it succeeded
+	Error string `json:"error,omitempty"`
+	// Failures counts failed reloads since start
+	Failures int `json:"failures"`
+}
+
+// generationStatus is the result of the last caddyfile generation
+type generationStatus struct {
+	time       time.Time
+	logs       string
+	directives map[string]*directiveData
+	endpoints  []endpointStatus
+	// rejected is the last caddyfile that failed validation or reload
+	rejected rejectedCaddyfile
+}
+
+type endpointStatus struct {
+	name           string
+	swarmAvailable bool
+	caddyNetworks  []string
+}
+
+type rejectedCaddyfile struct {
+	time      time.Time
+	caddyfile []byte
+	err       string
+}
+
+// reconcileRequest is a unit of work consumed by reconcile goroutine
+type reconcileRequest struct {
+	// endpoint is the docker host the request comes from, nil means all hosts
+	endpoint *dockerEndpoint
+	// event, when set, is applied to docker state cache before anything else
+	event *events.Message
+	// resync reloads the whole docker state cache of endpoint before generating caddyfile
+	resync bool
+	// debounce coalesces requests into a single update, limited by max wait
+	debounce bool
+	// reload triggers a caddy reload when caddyfile changes
+	reload bool
+	// done, when set, makes the update run immediately and receives its result
+	done chan bool
+}
+
 // CreateDockerLoader creates a docker loader
 func CreateDockerLoader() *DockerLoader {
+	events, _ := parseEventMatcher("default")
 	return &DockerLoader{
+		options: &LoaderOptions{
+			pollingInterval: defaultPollingInterval,
+			eventsDebounce:  defaultEventsDebounce,
+			eventsMaxWait:   defaultEventsMaxWait,
+			events:          events,
+		},
+		generatorOptions: &GeneratorOptions{},
+		reloadCaddy:      ReloadCaddy,
+		requests:         make(chan reconcileRequest, 64),
 		input: caddy.CaddyfileInput{
 			ServerTypeName: "http",
 		},
@@ -49,121 +191,346 @@ func (dockerLoader *DockerLoader) Load(serverType string) (caddy.Input, error) {
 	if serverType != "http" {
 		return nil, nil
 	}
-	if !dockerLoader.initialized {
-		dockerLoader.initialized = true
 
-		dockerClient, err := client.NewEnvClient()
-		if err != nil {
-			log.Printf("Docker connection failed: %v", err)
-			return nil, nil
-		}
+	dockerLoader.initOnce.Do(dockerLoader.start)
 
-		dockerPing, err := dockerClient.Ping(context.Background())
-		if err != nil {
-			log.Printf("Docker ping failed: %v", err)
-			return nil, nil
-		}
+	input := dockerLoader.getInput()
+	if input.Contents == nil {
+		// no caddyfile yet, let caddy use its default one
+		return nil, nil
+	}
 
-		dockerClient.NegotiateAPIVersionPing(dockerPing)
+	return input, nil
+}
 
-		dockerLoader.dockerClient = dockerClient
-		dockerLoader.generator = CreateGenerator(
-			WrapDockerClient(dockerClient),
-			CreateDockerUtils(),
-			GetGeneratorOptions(),
-		)
+func (dockerLoader *DockerLoader) getInput() caddy.CaddyfileInput {
+	dockerLoader.inputMutex.RLock()
+	defer dockerLoader.inputMutex.RUnlock()
+	return dockerLoader.input
+}
+
+func (dockerLoader *DockerLoader) setInput(input caddy.CaddyfileInput) {
+	dockerLoader.inputMutex.Lock()
+	defer dockerLoader.inputMutex.Unlock()
+	dockerLoader.input = input
+}
+
+func (dockerLoader *DockerLoader) start() {
+	dockerLoader.options = GetLoaderOptions()
+	log.Printf("[INFO] Docker process caddyfile: %v", dockerLoader.options.processCaddyfile)
+	log.Printf("[INFO] Docker polling interval: %v", dockerLoader.options.pollingInterval)
+	log.Printf("[INFO] Docker events debounce: %v, max wait: %v", dockerLoader.options.eventsDebounce, dockerLoader.options.eventsMaxWait)
+	log.Printf("[INFO] Docker events: %v", dockerLoader.options.events)
+	log.Printf("[INFO] Docker state file: %v", dockerLoader.options.stateFile)
+
+	endpoints, err := GetDockerEndpoints()
+	if err != nil {
+		log.Printf("Docker endpoints failed: %v", err)
+		// no docker host will ever be reachable, so last valid caddyfile is all that can be served
+		dockerLoader.loadState()
+		return
+	}
+
+	generatorOptions := GetGeneratorOptions()
+	if err := dockerLoader.addEndpoints(endpoints, generatorOptions); err != nil {
+		log.Printf("Docker connection failed: %v", err)
+		dockerLoader.loadState()
+		return
+	}
+
+	if dockerLoader.options.adminAddress != "" {
+		go dockerLoader.serveAdminAPI(dockerLoader.options.adminAddress)
+	}
 
-		if processCaddyfileEnv := os.Getenv("CADDY_DOCKER_PROCESS_CADDYFILE"); processCaddyfileEnv != "" {
-			dockerLoader.processCaddyfile = isTrue.MatchString(processCaddyfileEnv)
+	dockerLoader.connect(context.Background())
+}
+
+// connect starts generating caddyfiles when docker is reachable,
+// otherwise serves last valid caddyfile and waits for docker in background
+func (dockerLoader *DockerLoader) connect(ctx context.Context) {
+	if dockerLoader.pingEndpoints(ctx) {
+		dockerLoader.run(ctx, false)
+		return
+	}
+
+	dockerLoader.loadState()
+	go dockerLoader.waitForDocker(ctx)
+}
+
+// pingEndpoints returns true when any docker host is reachable
+func (dockerLoader *DockerLoader) pingEndpoints(ctx context.Context) bool {
+	reachable := false
+	for _, endpoint := range dockerLoader.endpoints {
+		if _, err := endpoint.client.Ping(ctx); err != nil {
+			// other hosts keep working, events monitor retries this one in background
+			log.Printf("[ERROR] Docker ping failed%v: %v", endpoint.logSuffix(), err)
 		} else {
-			dockerLoader.processCaddyfile = processCaddyfileFlag
+			reachable = true
 		}
-		log.Printf("[INFO] Docker process caddyfile: %v", dockerLoader.processCaddyfile)
+	}
+	return reachable
+}
 
-		if pollingIntervalEnv := os.Getenv("CADDY_DOCKER_POLLING_INTERVAL"); pollingIntervalEnv != "" {
-			if p, err := time.ParseDuration(pollingIntervalEnv); err != nil {
-				log.Printf("Failed to parse CADDY_DOCKER_POLLING_INTERVAL: %v", err)
-			} else {
-				pollingInterval = p
+// waitForDocker pings docker hosts with exponential backoff until one is reachable, then starts generating caddyfiles
+func (dockerLoader *DockerLoader) waitForDocker(ctx context.Context) {
+	for failures := 1; ; failures++ {
+		select {
+		case <-time.After(backoffDelay(failures, eventsReconnectMinDelay, eventsReconnectMaxDelay)):
+		case <-ctx.Done():
+			return
+		}
+
+		if dockerLoader.pingEndpoints(ctx) {
+			log.Printf("[INFO] Docker is reachable, generating caddyfile")
+			dockerLoader.run(ctx, true)
+			return
+		}
+	}
+}
+
+// addEndpoints creates clients for docker hosts caddyfile is generated from
+func (dockerLoader *DockerLoader) addEndpoints(endpoints []DockerEndpoint, generatorOptions *GeneratorOptions) error {
+	for _, endpoint := range endpoints {
+		if endpoint.Snapshot != "" {
+			snapshot, err := readSnapshot(endpoint.Snapshot)
+			if err != nil {
+				return err
 			}
+			snapshotClient := newSnapshotDockerClient(snapshot)
+			dockerLoader.addEndpoint(
+				endpoint.Name,
+				snapshotClient,
+				snapshotClient,
+				endpointGeneratorOptions(endpoint, generatorOptions),
+			)
+			continue
 		}
-		log.Printf("[INFO] Docker polling interval: %v", pollingInterval)
-		dockerLoader.timer = time.AfterFunc(pollingInterval, func() {
-			dockerLoader.update(true)
-		})
 
-		dockerLoader.update(false)
+		dockerClient, err := createDockerClient(endpoint)
+		if err != nil {
+			return err
+		}
 
-		go dockerLoader.monitorEvents()
+		wrappedClient := WrapDockerClient(dockerClient)
+		dockerLoader.addEndpoint(
+			endpoint.Name,
+			wrappedClient,
+			CreateDockerUtils(wrappedClient),
+			endpointGeneratorOptions(endpoint, generatorOptions),
+		)
 	}
-	return dockerLoader.input, nil
+
+	dockerLoader.generatorOptions = generatorOptions
+	return nil
 }
 
-func (dockerLoader *DockerLoader) monitorEvents() {
-	args := filters.NewArgs()
-	args.Add("scope", "swarm")
-	args.Add("scope", "local")
-	args.Add("type", "service")
-	args.Add("type", "container")
-	args.Add("type", "config")
+// addEndpoint adds a docker host caddyfile is generated from
+func (dockerLoader *DockerLoader) addEndpoint(name string, dockerClient DockerClient, dockerUtils DockerUtils, options *GeneratorOptions) *dockerEndpoint {
+	cache := newDockerCache(dockerClient)
+	endpoint := &dockerEndpoint{
+		name:      name,
+		client:    dockerClient,
+		cache:     cache,
+		generator: CreateGenerator(cache, dockerUtils, options),
+	}
+	dockerLoader.endpoints = append(dockerLoader.endpoints, endpoint)
+	return endpoint
+}
+
+// run starts reconcile goroutine and docker events monitors, waiting for the first caddyfile generation
+func (dockerLoader *DockerLoader) run(ctx context.Context, reload bool) {
+	go dockerLoader.reconcile(ctx)
 
-	ctx := context.Background()
-	cancelCtx, cancelFunc := context.WithCancel(ctx)
+	done := make(chan bool, 1)
+	dockerLoader.enqueue(ctx, reconcileRequest{resync: true, reload: reload, done: done})
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
 
-	eventsChan, errorChan := dockerLoader.dockerClient.Events(cancelCtx, types.EventsOptions{
-		Filters: args,
-	})
+	for _, endpoint := range dockerLoader.endpoints {
+		endpoint := endpoint
+		monitor := newEventsMonitor(
+			endpoint.client,
+			createEventsFilters(dockerLoader.options.events),
+			func(event events.Message) {
+				dockerLoader.enqueue(ctx, reconcileRequest{endpoint: endpoint, event: &event, debounce: true, reload: true})
+			},
+			func() {
+				log.Printf("[INFO] Forcing caddyfile regeneration after docker events reconnection%v", endpoint.logSuffix())
+				metricEventsReconnects.add(endpoint.name, 1)
+				dockerLoader.enqueue(ctx, reconcileRequest{endpoint: endpoint, resync: true, reload: true})
+			},
+		)
+		dockerLoader.statusMutex.Lock()
+		endpoint.eventsMonitor = monitor
+		dockerLoader.statusMutex.Unlock()
+		go monitor.run(ctx)
+	}
+}
 
-	forloop: // label the for loop so we can break out of it
-	for {
-		select {
-		case event := <-eventsChan:
-			if dockerLoader.skipEvents {
-				continue
+func (dockerLoader *DockerLoader) enqueue(ctx context.Context, request reconcileRequest) {
+	select {
+	case dockerLoader.requests <- request:
+	case <-ctx.Done():
+	}
+}
+
+// reconcile is the only goroutine allowed to generate caddyfiles and change loader state
+func (dockerLoader *DockerLoader) reconcile(ctx context.Context) {
+	pollingTimer := time.NewTimer(dockerLoader.options.pollingInterval)
+	defer pollingTimer.Stop()
+
+	var debounceTimer *time.Timer
+	var debounceChan <-chan time.Time
+
+	stopDebounce := func() {
+		if debounceTimer != nil {
+			debounceTimer.Stop()
+			debounceTimer = nil
+			debounceChan = nil
+		}
+	}
+
+	update := func(endpoint *dockerEndpoint, resync bool, reload bool) bool {
+		stopDebounce()
+		if !pollingTimer.Stop() {
+			select {
+			case <-pollingTimer.C:
+			default:
 			}
+		}
+		pollingTimer.Reset(dockerLoader.options.pollingInterval)
+		dockerLoader.pendingSince = time.Time{}
+		if resync {
+			for _, e := range dockerLoader.endpoints {
+				if endpoint != nil && e != endpoint {
+					continue
+				}
+				if err := e.cache.Resync(ctx); err != nil {
+					log.Printf("[ERROR] Docker state resync failed%v: %v\n", e.logSuffix(), err)
+				}
+				e.generator.invalidateCaddyNetworks()
+			}
+		}
+		return dockerLoader.update(reload)
+	}
 
-			update := (event.Type == "container" && event.Action == "create") ||
-				(event.Type == "container" && event.Action == "start") ||
-				(event.Type == "container" && event.Action == "stop") ||
-				(event.Type == "container" && event.Action == "die") ||
-				(event.Type == "container" && event.Action == "destroy") ||
-				(event.Type == "service" && event.Action == "create") ||
-				(event.Type == "service" && event.Action == "update") ||
-				(event.Type == "service" && event.Action == "remove") ||
-				(event.Type == "config" && event.Action == "create") ||
-				(event.Type == "config" && event.Action == "remove")
-
-			if update {
-				dockerLoader.skipEvents = true
-				dockerLoader.timer.Reset(100 * time.Millisecond)
+	for {
+		select {
+		case <-ctx.Done():
+			stopDebounce()
+			return
+		case request := <-dockerLoader.requests:
+			if request.event != nil {
+				if err := request.endpoint.cache.HandleEvent(ctx, *request.event); err != nil {
+					log.Printf("[ERROR] Failed to apply docker %v %v event%v: %v\n", request.event.Type, request.event.Action, request.endpoint.logSuffix(), err)
+				}
+				if request.event.Type == "container" || request.event.Type == "network" {
+					request.endpoint.generator.forgetFailedConnects()
+				}
+				if request.endpoint.generator.isCaddyNetworkEvent(*request.event) {
+					log.Printf("[INFO] Caddy container network %v event%v, refreshing caddy networks\n", request.event.Action, request.endpoint.logSuffix())
+					request.endpoint.generator.invalidateCaddyNetworks()
+				} else if !dockerLoader.options.events.Match(*request.event) {
+					continue
+				}
 			}
-		case err := <-errorChan:
-			if err == nil {
-				// docker client event error, is the docker socket no longer accessible?
-				// cancel the context, otherwise the for loop errors forever
-				cancelFunc()
-				break forloop // break out of the for loop
+			if request.done != nil {
+				request.done <- update(request.endpoint, request.resync, request.reload)
+			} else if !request.debounce {
+				update(request.endpoint, request.resync, request.reload)
 			} else {
-				// log unknown error
-				log.Println(err)
+				// wait for events to settle, but no longer than max wait since the first pending event
+				now := time.Now()
+				if dockerLoader.pendingSince.IsZero() {
+					dockerLoader.pendingSince = now
+				}
+				wait := dockerLoader.options.eventsDebounce
+				if maxWait := dockerLoader.options.eventsMaxWait; maxWait > 0 {
+					if remaining := dockerLoader.pendingSince.Add(maxWait).Sub(now); remaining < wait {
+						wait = remaining
+					}
+				}
+				stopDebounce()
+				debounceTimer = time.NewTimer(wait)
+				debounceChan = debounceTimer.C
 			}
+		case <-debounceChan:
+			update(nil, false, true)
+		case <-pollingTimer.C:
+			// polling resyncs docker state caches as a consistency check
+			update(nil, true, true)
+		}
+	}
+}
+
+// createEventsFilters requests events docker state cache is patched from, and events of types matched by configured patterns
+func createEventsFilters(matcher *eventMatcher) filters.Args {
+	args := filters.NewArgs()
+	args.Add("scope", "swarm")
+	args.Add("scope", "local")
+	for _, eventType := range appendUnique(append([]string{}, cachedEventTypes...), matcher.EventTypes()...) {
+		args.Add("type", eventType)
+	}
+	return args
+}
 
+// EventsStatus returns the state of docker events stream, or the least connected one when there are many docker hosts
+func (dockerLoader *DockerLoader) EventsStatus() EventsStatus {
+	status := EventsStatus{State: EventsDisconnected}
+	for i, endpoint := range dockerLoader.endpoints {
+		endpointStatus := dockerLoader.endpointEventsStatus(endpoint)
+		if i == 0 || endpointStatus.State < status.State {
+			status = endpointStatus
 		}
 	}
+	return status
 }
 
-func (dockerLoader *DockerLoader) update(reloadIfChanged bool) bool {
-	dockerLoader.timer.Reset(pollingInterval)
-	dockerLoader.skipEvents = false
+// EndpointsEventsStatus returns the state of docker events stream of each docker host
+func (dockerLoader *DockerLoader) EndpointsEventsStatus() map[string]EventsStatus {
+	statuses := map[string]EventsStatus{}
+	for _, endpoint := range dockerLoader.endpoints {
+		statuses[endpoint.name] = dockerLoader.endpointEventsStatus(endpoint)
+	}
+	return statuses
+}
+
+func (dockerLoader *DockerLoader) endpointEventsStatus(endpoint *dockerEndpoint) EventsStatus {
+	dockerLoader.statusMutex.RLock()
+	monitor := endpoint.eventsMonitor
+	dockerLoader.statusMutex.RUnlock()
+	if monitor == nil {
+		return EventsStatus{State: EventsDisconnected}
+	}
+	return monitor.Status()
+}
+
+func (dockerLoader *DockerLoader) generators() []*CaddyfileGenerator {
+	generators := []*CaddyfileGenerator{}
+	for _, endpoint := range dockerLoader.endpoints {
+		generators = append(generators, endpoint.generator)
+	}
+	return generators
+}
 
-	caddyfile, logs, err := dockerLoader.generator.GenerateCaddyFile()
+func (dockerLoader *DockerLoader) update(reloadIfChanged bool) bool {
+	start := time.Now()
+	caddyfile, directives, logs, err := generateCaddyfile(dockerLoader.generatorOptions, dockerLoader.generators())
+	metricGenerationDuration.observeSince("", start)
+	metricGenerations.add("", 1)
+	dockerLoader.setGenerationStatus(directives, logs, err)
 
-	// error is returned if docker swarm is down and we want to leave the caddyfile as is
+	// error is returned if docker swarm is down or sites conflict and we want to leave the caddyfile as is
 	if err != nil {
-		log.Printf("[INFO] ignoring docker swarm error, leaving caddyfile as is: %v\n", err.Error())
+		log.Printf("[INFO] ignoring caddyfile generation error, leaving caddyfile as is: %v\n", err.Error())
+		metricGenerationErrors.add("", 1)
 		return false
 	}
 
+	observeDirectives(directives)
+
 	caddyfileChanged := !bytes.Equal(dockerLoader.previousCaddyfile, caddyfile)
 	logsChanged := dockerLoader.previousLogs != logs
 	dockerLoader.previousCaddyfile = caddyfile
@@ -177,7 +544,7 @@ func (dockerLoader *DockerLoader) update(reloadIfChanged bool) bool {
 		return false
 	}
 
-	if dockerLoader.processCaddyfile {
+	if dockerLoader.options.processCaddyfile {
 		log.Printf("[INFO] Processing caddyfile")
 		caddyfile = ProcessCaddyfile(caddyfile)
 	}
@@ -194,15 +561,93 @@ func (dockerLoader *DockerLoader) update(reloadIfChanged bool) bool {
 	if err := caddy.ValidateAndExecuteDirectives(newInput, nil, true); err != nil {
 		log.Printf("[ERROR] CaddyFile error: %s", err)
 		log.Printf("[INFO] Wrong CaddyFile:\n%s", caddyfile)
-	} else {
-		log.Printf("[INFO] New CaddyFile:\n%s", newInput.Contents)
+		dockerLoader.setRejected(caddyfile, err)
+		metricRejected.add("", 1)
+		return true
+	}
 
-		dockerLoader.input = newInput
+	log.Printf("[INFO] New CaddyFile:\n%s", newInput.Contents)
 
-		if reloadIfChanged {
-			ReloadCaddy(dockerLoader)
+	servedInput := dockerLoader.getInput()
+	if reloadIfChanged && !bytes.Equal(servedInput.Contents, newInput.Contents) {
+		err := dockerLoader.reloadCaddy(newInput)
+		dockerLoader.setReloadStatus(err)
+		if err != nil {
+			metricReloads.add("failure", 1)
+			// caddy keeps running previous caddyfile, keep serving it to loads too
+			log.Printf("[ERROR] Caddy reload failed, keeping previous caddyfile: %v", err)
+			dockerLoader.setRejected(caddyfile, err)
+			// forget generated caddyfile so next generation retries the reload even if it didn't change
+			dockerLoader.previousCaddyfile = nil
+			return true
 		}
+		metricReloads.add("success", 1)
 	}
 
+	dockerLoader.setInput(newInput)
+	dockerLoader.saveState(newInput.Contents)
+
 	return true
 }
+
+func (dockerLoader *DockerLoader) setReloadStatus(err error) {
+	dockerLoader.statusMutex.Lock()
+	defer dockerLoader.statusMutex.Unlock()
+	dockerLoader.reloadStatus.Time = time.Now()
+	if err != nil {
+		dockerLoader.reloadStatus.Error = err.Error()
+		dockerLoader.reloadStatus.Failures++
+	} else {
+		dockerLoader.reloadStatus.Error = ""
+	}
+}
+
+// setGenerationStatus records generation result and docker hosts state.
+// Directives are kept when generation fails, as caddyfile isn't changed.
+func (dockerLoader *DockerLoader) setGenerationStatus(directives map[string]*directiveData, logs string, err error) {
+	endpoints := []endpointStatus{}
+	for _, endpoint := range dockerLoader.endpoints {
+		caddyNetworks := []string{}
+		for network := range endpoint.generator.caddyNetworks {
+			caddyNetworks = append(caddyNetworks, network)
+		}
+		sort.Strings(caddyNetworks)
+		endpoints = append(endpoints, endpointStatus{
+			name:           endpoint.name,
+			swarmAvailable: endpoint.generator.swarmIsAvailable,
+			caddyNetworks:  caddyNetworks,
+		})
+	}
+
+	dockerLoader.statusMutex.Lock()
+	defer dockerLoader.statusMutex.Unlock()
+	dockerLoader.generation.time = time.Now()
+	dockerLoader.generation.logs = logs
+	dockerLoader.generation.endpoints = endpoints
+	if err == nil {
+		dockerLoader.generation.directives = directives
+	}
+}
+
+func (dockerLoader *DockerLoader) setRejected(caddyfile []byte, err error) {
+	dockerLoader.statusMutex.Lock()
+	defer dockerLoader.statusMutex.Unlock()
+	dockerLoader.generation.rejected = rejectedCaddyfile{
+		time:      time.Now(),
+		caddyfile: caddyfile,
+		err:       err.Error(),
+	}
+}
+
+func (dockerLoader *DockerLoader) getGenerationStatus() generationStatus {
+	dockerLoader.statusMutex.RLock()
+	defer dockerLoader.statusMutex.RUnlock()
+	return dockerLoader.generation
+}
+
+// ReloadStatus returns the result of the last caddy reload
+func (dockerLoader *DockerLoader) ReloadStatus() ReloadStatus {
+	dockerLoader.statusMutex.RLock()
+	defer dockerLoader.statusMutex.RUnlock()
+	return dockerLoader.reloadStatus
+}
@@ -0,0 +1,341 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/network"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoader_CoalescesEventBurstIntoSingleReload(t *testing.T) {
+	eventsChan := make(chan events.Message)
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.MockEvents = func(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error) {
+		return eventsChan, make(chan error)
+	}
+
+	var reloads int32
+	loader := createTestLoader(dockerClient, &reloads)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	loader.run(ctx, false)
+
+	assert.Equal(t, "# Empty caddyfile", string(loader.getInput().Contents))
+
+	dockerClient.ContainersData = []types.Container{
+		createTestContainer("container-id", "service.testdomain.com"),
+	}
+
+	for i := 0; i < 50; i++ {
+		eventsChan <- events.Message{Type: "container", Action: "start", Actor: events.Actor{ID: "container-id"}}
+	}
+
+	waitFor(t, func() bool { return atomic.LoadInt32(&reloads) > 0 })
+	time.Sleep(5 * loader.options.eventsDebounce)
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&reloads))
+	assert.True(t, strings.HasPrefix(string(loader.getInput().Contents), "service.testdomain.com {"))
+}
+
+func TestLoader_MaxWaitLimitsDebounce(t *testing.T) {
+	eventsChan := make(chan events.Message)
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.MockEvents = func(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error) {
+		return eventsChan, make(chan error)
+	}
+
+	var reloads int32
+	loader := createTestLoader(dockerClient, &reloads)
+	loader.options.eventsDebounce = time.Hour
+	loader.options.eventsMaxWait = 50 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	loader.run(ctx, false)
+
+	dockerClient.ContainersData = []types.Container{
+		createTestContainer("container-id", "service.testdomain.com"),
+	}
+	eventsChan <- events.Message{Type: "container", Action: "start", Actor: events.Actor{ID: "container-id"}}
+
+	waitFor(t, func() bool { return atomic.LoadInt32(&reloads) > 0 })
+}
+
+func TestLoader_ConcurrentLoadsDuringUpdates(t *testing.T) {
+	eventsChan := make(chan events.Message)
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.MockEvents = func(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error) {
+		return eventsChan, make(chan error)
+	}
+
+	var reloads int32
+	loader := createTestLoader(dockerClient, &reloads)
+	loader.reloadCaddy = func(input caddy.Input) error {
+		atomic.AddInt32(&reloads, 1)
+		// caddy may load input while reloading
+		loader.Load("http")
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	loader.run(ctx, false)
+	loader.initOnce.Do(func() {})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				input, err := loader.Load("http")
+				assert.NoError(t, err)
+				assert.NotNil(t, input)
+			}
+		}()
+	}
+
+	for i := 0; i < 20; i++ {
+		eventsChan <- events.Message{Type: "service", Action: "update"}
+	}
+
+	wg.Wait()
+	assert.Equal(t, EventsConnected, loader.EventsStatus().State)
+}
+
+func TestLoader_UnreachableHostDoesNotBlockOthers(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ContainersData = []types.Container{
+		createTestContainer("container-id", "service.testdomain.com"),
+	}
+	unreachableClient := createBasicDockerClientMock()
+	unreachableClient.InfoError = fmt.Errorf("Cannot connect to the Docker daemon")
+
+	var reloads int32
+	loader := createTestLoader(dockerClient, &reloads)
+	loader.endpoints[0].generator.hostName = "host-a"
+	loader.addEndpoint("host-b", unreachableClient, createDockerUtilsMock(), &GeneratorOptions{
+		labelPrefix:     defaultLabelPrefix,
+		validateNetwork: true,
+		hostName:        "host-b",
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	loader.run(ctx, false)
+
+	assert.True(t, strings.HasPrefix(string(loader.getInput().Contents), "# docker hosts: host-a\nservice.testdomain.com {"))
+	assert.Len(t, loader.EndpointsEventsStatus(), 2)
+}
+
+func TestLoader_ServesStateFileUntilDockerIsReachable(t *testing.T) {
+	defer func(minDelay, maxDelay time.Duration) {
+		eventsReconnectMinDelay, eventsReconnectMaxDelay = minDelay, maxDelay
+	}(eventsReconnectMinDelay, eventsReconnectMaxDelay)
+	eventsReconnectMinDelay = 10 * time.Millisecond
+	eventsReconnectMaxDelay = 20 * time.Millisecond
+
+	stateDir, err := ioutil.TempDir("", "caddy-docker-proxy")
+	assert.NoError(t, err)
+	defer os.RemoveAll(stateDir)
+	stateFile := filepath.Join(stateDir, "Caddyfile")
+	assert.NoError(t, ioutil.WriteFile(stateFile, []byte("stale.testdomain.com {\n}\n"), 0600))
+
+	var dockerIsUp int32
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.MockPing = func(ctx context.Context) (types.Ping, error) {
+		if atomic.LoadInt32(&dockerIsUp) == 0 {
+			return types.Ping{}, fmt.Errorf("Cannot connect to the Docker daemon")
+		}
+		return types.Ping{}, nil
+	}
+	dockerClient.ContainersData = []types.Container{
+		createTestContainer("container-id", "service.testdomain.com"),
+	}
+
+	var reloads int32
+	loader := createTestLoader(dockerClient, &reloads)
+	loader.options.stateFile = stateFile
+	loader.initOnce.Do(func() {})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	loader.connect(ctx)
+
+	input, err := loader.Load("http")
+	assert.NoError(t, err)
+	assert.Equal(t, "stale.testdomain.com {\n}\n", string(input.Body()))
+
+	atomic.StoreInt32(&dockerIsUp, 1)
+	waitFor(t, func() bool { return atomic.LoadInt32(&reloads) > 0 })
+
+	contents := loader.getInput().Contents
+	assert.True(t, strings.HasPrefix(string(contents), "service.testdomain.com {"))
+	savedContents, err := ioutil.ReadFile(stateFile)
+	assert.NoError(t, err)
+	assert.Equal(t, contents, savedContents)
+}
+
+func TestLoader_ServesStateFileWhenEndpointsFail(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", "caddy-docker-proxy")
+	assert.NoError(t, err)
+	defer os.RemoveAll(stateDir)
+	stateFile := filepath.Join(stateDir, "Caddyfile")
+	assert.NoError(t, ioutil.WriteFile(stateFile, []byte("stale.testdomain.com {\n}\n"), 0600))
+
+	os.Setenv("CADDY_DOCKER_STATE_FILE", stateFile)
+	defer os.Unsetenv("CADDY_DOCKER_STATE_FILE")
+	os.Setenv("CADDY_DOCKER_ENDPOINTS_FILE", filepath.Join(stateDir, "missing-endpoints.json"))
+	defer os.Unsetenv("CADDY_DOCKER_ENDPOINTS_FILE")
+
+	loader := CreateDockerLoader()
+	loader.start()
+
+	assert.Equal(t, "stale.testdomain.com {\n}\n", string(loader.getInput().Contents))
+}
+
+func TestLoader_KeepsPreviousCaddyfileWhenReloadFails(t *testing.T) {
+	eventsChan := make(chan events.Message)
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.MockEvents = func(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error) {
+		return eventsChan, make(chan error)
+	}
+
+	var reloads int32
+	failReloads := int32(1)
+	loader := createTestLoader(dockerClient, &reloads)
+	loader.reloadCaddy = func(input caddy.Input) error {
+		atomic.AddInt32(&reloads, 1)
+		if atomic.LoadInt32(&failReloads) == 1 {
+			return fmt.Errorf("listen tcp :443: bind: address already in use")
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	loader.run(ctx, false)
+
+	dockerClient.ContainersData = []types.Container{
+		createTestContainer("container-id", "service.testdomain.com"),
+	}
+	eventsChan <- events.Message{Type: "container", Action: "start", Actor: events.Actor{ID: "container-id"}}
+
+	waitFor(t, func() bool { return loader.ReloadStatus().Failures > 0 })
+
+	status := loader.ReloadStatus()
+	assert.Equal(t, "listen tcp :443: bind: address already in use", status.Error)
+	assert.Equal(t, "# Empty caddyfile", string(loader.getInput().Contents))
+
+	// next event retries the reload even though generated caddyfile didn't change
+	atomic.StoreInt32(&failReloads, 0)
+	eventsChan <- events.Message{Type: "container", Action: "start", Actor: events.Actor{ID: "container-id"}}
+
+	waitFor(t, func() bool { return strings.Contains(string(loader.getInput().Contents), "service.testdomain.com") })
+
+	assert.Equal(t, int32(2), atomic.LoadInt32(&reloads))
+	assert.Empty(t, loader.ReloadStatus().Error)
+}
+
+func TestLoader_RefreshesCaddyNetworksOnConnect(t *testing.T) {
+	eventsChan := make(chan events.Message)
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.MockEvents = func(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error) {
+		return eventsChan, make(chan error)
+	}
+	container := createTestContainer("container-id", "service.testdomain.com")
+	container.NetworkSettings.Networks = map[string]*network.EndpointSettings{
+		"new-network": &network.EndpointSettings{
+			IPAddress: "172.18.0.2",
+			NetworkID: "new-network-id",
+		},
+	}
+	dockerClient.ContainersData = []types.Container{container}
+
+	var reloads int32
+	loader := createTestLoader(dockerClient, &reloads)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	loader.run(ctx, false)
+
+	assert.Equal(t, "# Empty caddyfile", string(loader.getInput().Contents))
+
+	dockerClient.ContainerInspectData[caddyContainerID].NetworkSettings.Networks["new-network"] = &network.EndpointSettings{
+		NetworkID: "new-network-id",
+	}
+	eventsChan <- events.Message{
+		Type:   "network",
+		Action: "connect",
+		Actor: events.Actor{
+			ID:         "new-network-id",
+			Attributes: map[string]string{"container": caddyContainerID},
+		},
+	}
+
+	waitFor(t, func() bool { return atomic.LoadInt32(&reloads) > 0 })
+
+	assert.Contains(t, string(loader.getInput().Contents), "proxy / 172.18.0.2")
+	assert.Contains(t, loader.getGenerationStatus().logs, "[INFO] Caddy networks changed from [network-id] to [network-id new-network-id]\n")
+}
+
+func TestReloadCaddy_FailsBeforeCaddyStarts(t *testing.T) {
+	// a reload error makes loader retry the caddyfile on next generation
+	err := ReloadCaddy(caddy.CaddyfileInput{ServerTypeName: "http"})
+	assert.EqualError(t, err, "Caddy hasn't started yet")
+}
+
+func createTestLoader(dockerClient *dockerClientMock, reloads *int32) *DockerLoader {
+	loader := CreateDockerLoader()
+	loader.addEndpoint("", dockerClient, createDockerUtilsMock(), &GeneratorOptions{
+		labelPrefix:     defaultLabelPrefix,
+		validateNetwork: true,
+	})
+	loader.options.pollingInterval = time.Hour
+	loader.reloadCaddy = func(caddy.Input) error {
+		atomic.AddInt32(reloads, 1)
+		return nil
+	}
+	return loader
+}
+
+func createTestContainer(id string, address string) types.Container {
+	return types.Container{
+		ID: id,
+		NetworkSettings: &types.SummaryNetworkSettings{
+			Networks: map[string]*network.EndpointSettings{
+				"caddy-network": &network.EndpointSettings{
+					IPAddress: "172.17.0.2",
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+		Labels: map[string]string{
+			fmtLabel("%s.address"): address,
+			fmtLabel("%s.tls"):     "off",
+		},
+	}
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
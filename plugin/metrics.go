@@ -0,0 +1,248 @@
+package plugin
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var durationBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10}
+
+// metrics are exposed in prometheus text format by admin API, so only when it is enabled
+var (
+	metricGenerations        = newCounter("caddy_docker_generations_total", "Caddyfile generations.", "")
+	metricGenerationErrors   = newCounter("caddy_docker_generation_errors_total", "Caddyfile generations skipped because of docker swarm errors or rejected conflicts.", "")
+	metricGenerationDuration = newHistogram("caddy_docker_generation_duration_seconds", "Duration of caddyfile generations.", "", durationBuckets)
+	metricRejected           = newCounter("caddy_docker_caddyfiles_rejected_total", "Generated caddyfiles that failed validation.", "")
+	metricRemovedBlocks      = newCounter("caddy_docker_server_blocks_removed_total", "Invalid server blocks removed when processing caddyfile.", "")
+	metricReloads            = newCounter("caddy_docker_reloads_total", "Caddy reloads by result.", "result")
+	metricSites              = newGauge("caddy_docker_sites", "Sites in generated caddyfile.", "")
+	metricUpstreams          = newGauge("caddy_docker_upstreams", "Proxy upstreams in generated caddyfile.", "")
+	metricEventsReconnects   = newCounter("caddy_docker_events_reconnects_total", "Docker events stream reconnections by docker host.", "host")
+	metricAPICallDuration    = newHistogram("caddy_docker_api_call_duration_seconds", "Duration of docker API calls by method.", "method", durationBuckets)
+	metricAPICallErrors      = newCounter("caddy_docker_api_call_errors_total", "Failed docker API calls by method.", "method")
+)
+
+var metricsRegistry = []metricWriter{
+	metricGenerations,
+	metricGenerationErrors,
+	metricGenerationDuration,
+	metricRejected,
+	metricRemovedBlocks,
+	metricReloads,
+	metricSites,
+	metricUpstreams,
+	metricEventsReconnects,
+	metricAPICallDuration,
+	metricAPICallErrors,
+}
+
+type metricWriter interface {
+	write(buffer *bytes.Buffer)
+}
+
+// metricVec is a counter or gauge, optionally partitioned by one label
+type metricVec struct {
+	name       string
+	help       string
+	metricType string
+	label      string
+	mutex      sync.Mutex
+	values     map[string]float64
+}
+
+func newCounter(name string, help string, label string) *metricVec {
+	return newMetricVec(name, help, "counter", label)
+}
+
+func newGauge(name string, help string, label string) *metricVec {
+	return newMetricVec(name, help, "gauge", label)
+}
+
+func newMetricVec(name string, help string, metricType string, label string) *metricVec {
+	metric := &metricVec{
+		name:       name,
+		help:       help,
+		metricType: metricType,
+		label:      label,
+		values:     map[string]float64{},
+	}
+	if label == "" {
+		metric.values[""] = 0
+	}
+	return metric
+}
+
+func (metric *metricVec) add(labelValue string, delta float64) {
+	metric.mutex.Lock()
+	defer metric.mutex.Unlock()
+	metric.values[labelValue] += delta
+}
+
+func (metric *metricVec) set(labelValue string, value float64) {
+	metric.mutex.Lock()
+	defer metric.mutex.Unlock()
+	metric.values[labelValue] = value
+}
+
+func (metric *metricVec) get(labelValue string) float64 {
+	metric.mutex.Lock()
+	defer metric.mutex.Unlock()
+	return metric.values[labelValue]
+}
+
+func (metric *metricVec) write(buffer *bytes.Buffer) {
+	metric.mutex.Lock()
+	defer metric.mutex.Unlock()
+
+	writeMetricHeader(buffer, metric.name, metric.help, metric.metricType)
+	for _, labelValue := range sortedMetricLabels(metric.values) {
+		writeMetricSample(buffer, metric.name, formatMetricLabels(metric.label, labelValue, ""), metric.values[labelValue])
+	}
+}
+
+// histogram counts observations in cumulative buckets, optionally partitioned by one label
+type histogram struct {
+	name    string
+	help    string
+	label   string
+	buckets []float64
+	mutex   sync.Mutex
+	values  map[string]*histogramValues
+}
+
+type histogramValues struct {
+	bucketCounts []uint64
+	count        uint64
+	sum          float64
+}
+
+func newHistogram(name string, help string, label string, buckets []float64) *histogram {
+	return &histogram{
+		name:    name,
+		help:    help,
+		label:   label,
+		buckets: buckets,
+		values:  map[string]*histogramValues{},
+	}
+}
+
+func (metric *histogram) observe(labelValue string, value float64) {
+	metric.mutex.Lock()
+	defer metric.mutex.Unlock()
+
+	values, exists := metric.values[labelValue]
+	if !exists {
+		values = &histogramValues{bucketCounts: make([]uint64, len(metric.buckets))}
+		metric.values[labelValue] = values
+	}
+	for i, bucket := range metric.buckets {
+		if value <= bucket {
+			values.bucketCounts[i]++
+		}
+	}
+	values.count++
+	values.sum += value
+}
+
+func (metric *histogram) observeSince(labelValue string, start time.Time) {
+	metric.observe(labelValue, time.Since(start).Seconds())
+}
+
+func (metric *histogram) write(buffer *bytes.Buffer) {
+	metric.mutex.Lock()
+	defer metric.mutex.Unlock()
+
+	writeMetricHeader(buffer, metric.name, metric.help, "histogram")
+
+	labelValues := []string{}
+	for labelValue := range metric.values {
+		labelValues = append(labelValues, labelValue)
+	}
+	sort.Strings(labelValues)
+
+	for _, labelValue := range labelValues {
+		values := metric.values[labelValue]
+		for i, bucket := range metric.buckets {
+			le := strconv.FormatFloat(bucket, 'g', -1, 64)
+			writeMetricSample(buffer, metric.name+"_bucket", formatMetricLabels(metric.label, labelValue, le), float64(values.bucketCounts[i]))
+		}
+		writeMetricSample(buffer, metric.name+"_bucket", formatMetricLabels(metric.label, labelValue, "+Inf"), float64(values.count))
+		writeMetricSample(buffer, metric.name+"_sum", formatMetricLabels(metric.label, labelValue, ""), values.sum)
+		writeMetricSample(buffer, metric.name+"_count", formatMetricLabels(metric.label, labelValue, ""), float64(values.count))
+	}
+}
+
+func writeMetricHeader(buffer *bytes.Buffer, name string, help string, metricType string) {
+	buffer.WriteString(fmt.Sprintf("# HELP %v %v\n", name, help))
+	buffer.WriteString(fmt.Sprintf("# TYPE %v %v\n", name, metricType))
+}
+
+func writeMetricSample(buffer *bytes.Buffer, name string, labels string, value float64) {
+	buffer.WriteString(fmt.Sprintf("%v%v %v\n", name, labels, strconv.FormatFloat(value, 'g', -1, 64)))
+}
+
+func formatMetricLabels(label string, labelValue string, le string) string {
+	labels := []string{}
+	if label != "" {
+		labels = append(labels, fmt.Sprintf("%v=\"%v\"", label, escapeMetricLabel(labelValue)))
+	}
+	if le != "" {
+		labels = append(labels, fmt.Sprintf("le=\"%v\"", le))
+	}
+	if len(labels) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+var metricLabelEscaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+
+func escapeMetricLabel(value string) string {
+	return metricLabelEscaper.Replace(value)
+}
+
+func sortedMetricLabels(values map[string]float64) []string {
+	labelValues := []string{}
+	for labelValue := range values {
+		labelValues = append(labelValues, labelValue)
+	}
+	sort.Strings(labelValues)
+	return labelValues
+}
+
+// observeDockerAPICall records duration and failure of a docker API call
+func observeDockerAPICall(method string, start time.Time, err error) {
+	metricAPICallDuration.observeSince(method, start)
+	if err != nil {
+		metricAPICallErrors.add(method, 1)
+	}
+}
+
+// observeDirectives records the number of sites and proxy upstreams in generated directives
+func observeDirectives(directives map[string]*directiveData) {
+	upstreams := 0
+	for _, site := range directives {
+		for _, child := range site.children {
+			if child.name == "proxy" && len(child.args) > 1 {
+				upstreams += len(child.args) - 1
+			}
+		}
+	}
+	metricSites.set("", float64(len(directives)))
+	metricUpstreams.set("", float64(upstreams))
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	var buffer bytes.Buffer
+	for _, metric := range metricsRegistry {
+		metric.write(&buffer)
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buffer.Bytes())
+}
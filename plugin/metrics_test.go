@@ -0,0 +1,67 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics_WritesPrometheusText(t *testing.T) {
+	counter := newCounter("test_calls_total", "Test calls.", "method")
+	counter.add("Info", 1)
+	counter.add("Ping", 2)
+	counter.add("Info", 1)
+
+	histogram := newHistogram("test_duration_seconds", "Test duration.", "", []float64{0.1, 1})
+	histogram.observe("", 0.05)
+	histogram.observe("", 0.5)
+	histogram.observe("", 5)
+
+	var buffer bytes.Buffer
+	counter.write(&buffer)
+	histogram.write(&buffer)
+
+	const expectedText = "# HELP test_calls_total Test calls.\n" +
+		"# TYPE test_calls_total counter\n" +
+		"test_calls_total{method=\"Info\"} 2\n" +
+		"test_calls_total{method=\"Ping\"} 2\n" +
+		"# HELP test_duration_seconds Test duration.\n" +
+		"# TYPE test_duration_seconds histogram\n" +
+		"test_duration_seconds_bucket{le=\"0.1\"} 1\n" +
+		"test_duration_seconds_bucket{le=\"1\"} 2\n" +
+		"test_duration_seconds_bucket{le=\"+Inf\"} 3\n" +
+		"test_duration_seconds_sum 5.55\n" +
+		"test_duration_seconds_count 3\n"
+
+	assert.Equal(t, expectedText, buffer.String())
+}
+
+func TestMetrics_ObservesGeneration(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ContainersData = []types.Container{
+		createTestContainer("container-a", "service.testdomain.com"),
+		createTestContainer("container-b", "service.testdomain.com"),
+	}
+
+	generations := metricGenerations.get("")
+
+	var reloads int32
+	loader := createTestLoader(dockerClient, &reloads)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	loader.run(ctx, false)
+
+	assert.Equal(t, generations+1, metricGenerations.get(""))
+	assert.Equal(t, float64(1), metricSites.get(""))
+	assert.Equal(t, float64(2), metricUpstreams.get(""))
+
+	response := serveAdminRequest(loader.createAdminHandler(), http.MethodGet, "/metrics")
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.True(t, strings.Contains(response.Body.String(), "\ncaddy_docker_sites 1\n"))
+}
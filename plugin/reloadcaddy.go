@@ -0,0 +1,22 @@
+package plugin
+
+import (
+	"fmt"
+
+	"github.com/caddyserver/caddy"
+)
+
+// startedInstances returns caddy instances to reload, failing while caddy is still starting,
+// so caddyfiles generated before caddy starts are reloaded on a later generation instead of being lost
+func startedInstances() ([]*caddy.Instance, error) {
+	instances := caddy.Instances()
+	if len(instances) == 0 {
+		return nil, fmt.Errorf("Caddy hasn't started yet")
+	}
+	for _, instance := range instances {
+		if len(instance.Servers()) == 0 {
+			return nil, fmt.Errorf("Caddy is still starting")
+		}
+	}
+	return instances, nil
+}
@@ -3,13 +3,40 @@
 package plugin
 
 import (
-	"os"
-	"syscall"
+	"fmt"
+	"strings"
 
 	"github.com/caddyserver/caddy"
 )
 
-func ReloadCaddy(loader caddy.Loader) {
-	self, _ := os.FindProcess(os.Getpid())
-	self.Signal(syscall.SIGUSR1)
+// ReloadCaddy gracefully restarts caddy instances with input.
+// An instance that fails to restart keeps running its previous caddyfile,
+// the error tells which instances were already restarted with input.
+func ReloadCaddy(input caddy.Input) error {
+	instances, err := startedInstances()
+	if err != nil {
+		return err
+	}
+	restarted := []string{}
+	for i, instance := range instances {
+		if _, err := instance.Restart(input); err != nil {
+			if len(restarted) > 0 {
+				return fmt.Errorf("%v, caddyfile partially applied to instances %v", err, strings.Join(restarted, ", "))
+			}
+			return err
+		}
+		restarted = append(restarted, describeInstance(i, instance))
+	}
+	return nil
+}
+
+// describeInstance names an instance by its position and listening addresses
+func describeInstance(index int, instance *caddy.Instance) string {
+	addresses := []string{}
+	for _, server := range instance.Servers() {
+		if addr := server.Addr(); addr != nil {
+			addresses = append(addresses, addr.String())
+		}
+	}
+	return fmt.Sprintf("#%v (%v)", index, strings.Join(addresses, " "))
 }
@@ -1,6 +1,7 @@
 package plugin
 
 import (
+	"fmt"
 	"log"
 	"time"
 
@@ -9,36 +10,40 @@ import (
 	httpserver "github.com/caddyserver/caddy/caddyhttp/httpserver"
 )
 
-// ReloadCaddy reloads caddy
-func ReloadCaddy(loader caddy.Loader) {
+// ReloadCaddy reloads caddy, starting previous caddyfile again when input fails to start.
+// Graceful restarts aren't supported on windows, so instances are stopped before starting new ones.
+func ReloadCaddy(input caddy.Input) error {
 	httpserver.GracefulTimeout = 20 * time.Second
 
-	log.Printf("[INFO] Reloading\n")
+	instances, err := startedInstances()
+	if err != nil {
+		return err
+	}
 
-	instances := caddy.Instances()
+	log.Printf("[INFO] Reloading\n")
 
 	for _, instance := range instances {
+		previousInput := instance.Caddyfile()
+
 		log.Printf("[INFO] Stopping current instance")
 
 		instance.ShutdownCallbacks()
 
-		err := instance.Stop()
+		err = instance.Stop()
 		if err != nil {
-			log.Printf("[ERROR] %v", err.Error())
-			log.Fatal(err)
-		}
-
-		input, err := loader.Load("http")
-		if err != nil {
-			log.Printf("[ERROR] %v", err.Error())
-			log.Fatal(err)
+			return err
 		}
 
 		log.Printf("[INFO] Starting new instance")
-		instance, err = caddy.Start(input)
+		_, err = caddy.Start(input)
 		if err != nil {
-			log.Printf("[ERROR] %v", err.Error())
-			log.Fatal(err)
+			log.Printf("[ERROR] Starting new instance failed, starting previous one: %v", err)
+			if _, rollbackErr := caddy.Start(previousInput); rollbackErr != nil {
+				return fmt.Errorf("%v, starting previous instance also failed: %v", err, rollbackErr)
+			}
+			return err
 		}
 	}
+
+	return nil
 }
@@ -0,0 +1,242 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/errdefs"
+)
+
+// snapshotVersion is incremented on incompatible changes to DockerSnapshot format
+const snapshotVersion = 1
+
+// DockerSnapshot is the docker state seen by caddyfile generator
+type DockerSnapshot struct {
+	Version          int                     `json:"version"`
+	Info             types.Info              `json:"info"`
+	CaddyContainerID string                  `json:"caddyContainerId"`
+	CaddyContainer   *types.ContainerJSON    `json:"caddyContainer,omitempty"`
+	Containers       []types.Container       `json:"containers"`
+	Services         []swarm.Service         `json:"services"`
+	Tasks            []swarm.Task            `json:"tasks"`
+	Configs          []swarm.Config          `json:"configs"`
+	Networks         []types.NetworkResource `json:"networks"`
+}
+
+// DumpSnapshot writes a JSON snapshot of docker host from docker environment variables to output
+func DumpSnapshot(output io.Writer) error {
+	dockerClient, err := createDockerClient(DockerEndpoint{})
+	if err != nil {
+		return err
+	}
+
+	wrappedClient := WrapDockerClient(dockerClient)
+	snapshot, err := createSnapshot(context.Background(), wrappedClient, CreateDockerUtils(wrappedClient))
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(output)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(snapshot)
+}
+
+// createSnapshot reads all docker objects caddyfile generator may use
+func createSnapshot(ctx context.Context, dockerClient DockerClient, dockerUtils DockerUtils) (*DockerSnapshot, error) {
+	snapshot := &DockerSnapshot{
+		Version:    snapshotVersion,
+		Containers: []types.Container{},
+		Services:   []swarm.Service{},
+		Tasks:      []swarm.Task{},
+		Configs:    []swarm.Config{},
+		Networks:   []types.NetworkResource{},
+	}
+
+	var err error
+	if snapshot.Info, err = dockerClient.Info(ctx); err != nil {
+		return nil, err
+	}
+
+	// caddy may run outside docker, leaving caddy container empty
+	if containerID, err := dockerUtils.GetCurrentContainerID(); err == nil {
+		snapshot.CaddyContainerID = containerID
+		if container, err := dockerClient.ContainerInspect(ctx, containerID); err == nil {
+			snapshot.CaddyContainer = &container
+		}
+	}
+
+	if snapshot.Containers, err = dockerClient.ContainerList(ctx, types.ContainerListOptions{}); err != nil {
+		return nil, err
+	}
+	if snapshot.Networks, err = dockerClient.NetworkList(ctx, types.NetworkListOptions{}); err != nil {
+		return nil, err
+	}
+
+	if snapshot.Info.Swarm.LocalNodeState != swarm.LocalNodeStateActive {
+		return snapshot, nil
+	}
+
+	if snapshot.Services, err = dockerClient.ServiceList(ctx, types.ServiceListOptions{}); err != nil {
+		return nil, err
+	}
+	if snapshot.Tasks, err = dockerClient.TaskList(ctx, types.TaskListOptions{}); err != nil {
+		return nil, err
+	}
+	configs, err := dockerClient.ConfigList(ctx, types.ConfigListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for _, config := range configs {
+		// config list doesn't return config data
+		fullConfig, _, err := dockerClient.ConfigInspectWithRaw(ctx, config.ID)
+		if err != nil {
+			return nil, err
+		}
+		snapshot.Configs = append(snapshot.Configs, fullConfig)
+	}
+
+	return snapshot, nil
+}
+
+// readSnapshot reads a JSON snapshot file
+func readSnapshot(path string) (*DockerSnapshot, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &DockerSnapshot{}
+	if err := json.Unmarshal(content, snapshot); err != nil {
+		return nil, fmt.Errorf("Invalid docker snapshot %v: %v", path, err)
+	}
+	if snapshot.Version != snapshotVersion {
+		return nil, fmt.Errorf("Docker snapshot %v has version %v, expected %v", path, snapshot.Version, snapshotVersion)
+	}
+
+	return snapshot, nil
+}
+
+// snapshotDockerClient is a DockerClient and DockerUtils replaying a docker snapshot
+type snapshotDockerClient struct {
+	snapshot *DockerSnapshot
+}
+
+func newSnapshotDockerClient(snapshot *DockerSnapshot) *snapshotDockerClient {
+	return &snapshotDockerClient{snapshot: snapshot}
+}
+
+// GetCurrentContainerID returns caddy container ID recorded in snapshot
+func (client *snapshotDockerClient) GetCurrentContainerID() (string, error) {
+	if client.snapshot.CaddyContainerID == "" {
+		return "", fmt.Errorf("Docker snapshot doesn't have caddy container")
+	}
+	return client.snapshot.CaddyContainerID, nil
+}
+
+func (client *snapshotDockerClient) ContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+	containers := []types.Container{}
+	for _, container := range client.snapshot.Containers {
+		if options.Filters.Match("id", container.ID) {
+			containers = append(containers, container)
+		}
+	}
+	return containers, nil
+}
+
+func (client *snapshotDockerClient) ServiceList(ctx context.Context, options types.ServiceListOptions) ([]swarm.Service, error) {
+	services := []swarm.Service{}
+	for _, service := range client.snapshot.Services {
+		if options.Filters.Match("id", service.ID) {
+			services = append(services, service)
+		}
+	}
+	return services, nil
+}
+
+func (client *snapshotDockerClient) TaskList(ctx context.Context, options types.TaskListOptions) ([]swarm.Task, error) {
+	tasks := []swarm.Task{}
+	for _, task := range client.snapshot.Tasks {
+		if options.Filters.ExactMatch("service", task.ServiceID) &&
+			options.Filters.ExactMatch("desired-state", string(task.DesiredState)) {
+			tasks = append(tasks, task)
+		}
+	}
+	return tasks, nil
+}
+
+func (client *snapshotDockerClient) Info(ctx context.Context) (types.Info, error) {
+	return client.snapshot.Info, nil
+}
+
+func (client *snapshotDockerClient) ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error) {
+	// only caddy container is inspected by generator
+	if client.snapshot.CaddyContainer != nil && containerID == client.snapshot.CaddyContainerID {
+		return *client.snapshot.CaddyContainer, nil
+	}
+	return types.ContainerJSON{}, errdefs.NotFound(fmt.Errorf("No such container: %v", containerID))
+}
+
+func (client *snapshotDockerClient) NetworkInspect(ctx context.Context, networkID string, options types.NetworkInspectOptions) (types.NetworkResource, error) {
+	for _, network := range client.snapshot.Networks {
+		if network.ID == networkID {
+			return network, nil
+		}
+	}
+	return types.NetworkResource{}, errdefs.NotFound(fmt.Errorf("No such network: %v", networkID))
+}
+
+func (client *snapshotDockerClient) NetworkList(ctx context.Context, options types.NetworkListOptions) ([]types.NetworkResource, error) {
+	networks := []types.NetworkResource{}
+	for _, network := range client.snapshot.Networks {
+		if options.Filters.Match("id", network.ID) {
+			networks = append(networks, network)
+		}
+	}
+	return networks, nil
+}
+
+// NetworkConnect fails, as snapshot is read only
+func (client *snapshotDockerClient) NetworkConnect(ctx context.Context, networkID, containerID string, config *network.EndpointSettings) error {
+	return fmt.Errorf("Docker snapshot is read only")
+}
+
+// NetworkDisconnect fails, as snapshot is read only
+func (client *snapshotDockerClient) NetworkDisconnect(ctx context.Context, networkID, containerID string, force bool) error {
+	return fmt.Errorf("Docker snapshot is read only")
+}
+
+func (client *snapshotDockerClient) ConfigList(ctx context.Context, options types.ConfigListOptions) ([]swarm.Config, error) {
+	configs := []swarm.Config{}
+	for _, config := range client.snapshot.Configs {
+		if options.Filters.Match("id", config.ID) {
+			configs = append(configs, config)
+		}
+	}
+	return configs, nil
+}
+
+func (client *snapshotDockerClient) ConfigInspectWithRaw(ctx context.Context, id string) (swarm.Config, []byte, error) {
+	for _, config := range client.snapshot.Configs {
+		if config.ID == id {
+			raw, err := json.Marshal(config)
+			return config, raw, err
+		}
+	}
+	return swarm.Config{}, nil, errdefs.NotFound(fmt.Errorf("No such config: %v", id))
+}
+
+func (client *snapshotDockerClient) Ping(ctx context.Context) (types.Ping, error) {
+	return types.Ping{}, nil
+}
+
+// Events never sends events, as snapshot doesn't change
+func (client *snapshotDockerClient) Events(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error) {
+	return make(chan events.Message), make(chan error)
+}
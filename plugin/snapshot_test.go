@@ -0,0 +1,75 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshot_ReplaysSameCaddyfile(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ContainersData = []types.Container{
+		createTestContainer("container-id", "container.testdomain.com"),
+	}
+	dockerClient.ServicesData = []swarm.Service{
+		createTestService("service-id", "service.testdomain.com"),
+	}
+	dockerClient.ConfigsData = []swarm.Config{
+		swarm.Config{
+			ID: "config-id",
+			Spec: swarm.ConfigSpec{
+				Annotations: swarm.Annotations{
+					Labels: map[string]string{
+						fmtLabel("%s"): "",
+					},
+				},
+				Data: []byte("config.testdomain.com {\n}"),
+			},
+		},
+	}
+
+	options := &GeneratorOptions{
+		labelPrefix:     defaultLabelPrefix,
+		validateNetwork: true,
+	}
+	expectedCaddyfile, expectedLogs, err := CreateGenerator(dockerClient, createDockerUtilsMock(), options).GenerateCaddyFile()
+	assert.NoError(t, err)
+
+	snapshot, err := createSnapshot(context.Background(), dockerClient, createDockerUtilsMock())
+	assert.NoError(t, err)
+
+	snapshotDir, err := ioutil.TempDir("", "caddy-docker-proxy")
+	assert.NoError(t, err)
+	defer os.RemoveAll(snapshotDir)
+	snapshotFile := filepath.Join(snapshotDir, "snapshot.json")
+	content, err := json.Marshal(snapshot)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(snapshotFile, content, 0600))
+
+	replayedSnapshot, err := readSnapshot(snapshotFile)
+	assert.NoError(t, err)
+	snapshotClient := newSnapshotDockerClient(replayedSnapshot)
+
+	caddyfile, logs, err := CreateGenerator(snapshotClient, snapshotClient, options).GenerateCaddyFile()
+	assert.NoError(t, err)
+	assert.Equal(t, string(expectedCaddyfile), string(caddyfile))
+	assert.Equal(t, expectedLogs, logs)
+}
+
+func TestSnapshot_RejectsOtherVersions(t *testing.T) {
+	snapshotDir, err := ioutil.TempDir("", "caddy-docker-proxy")
+	assert.NoError(t, err)
+	defer os.RemoveAll(snapshotDir)
+	snapshotFile := filepath.Join(snapshotDir, "snapshot.json")
+	assert.NoError(t, ioutil.WriteFile(snapshotFile, []byte(`{"version": 999}`), 0600))
+
+	_, err = readSnapshot(snapshotFile)
+	assert.Error(t, err)
+}
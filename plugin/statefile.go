@@ -0,0 +1,61 @@
+package plugin
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/caddyserver/caddy"
+)
+
+// loadState serves the last valid caddyfile saved to state file
+func (dockerLoader *DockerLoader) loadState() {
+	stateFile := dockerLoader.options.stateFile
+	if stateFile == "" {
+		return
+	}
+
+	contents, err := ioutil.ReadFile(stateFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			log.Printf("[INFO] No last valid caddyfile at %v\n", stateFile)
+		} else {
+			log.Printf("[ERROR] Failed to read last valid caddyfile: %v\n", err)
+		}
+		return
+	}
+
+	log.Printf("[INFO] Serving last valid caddyfile from %v until docker is reachable\n", stateFile)
+	dockerLoader.setInput(caddy.CaddyfileInput{
+		ServerTypeName: "http",
+		Contents:       contents,
+		Filepath:       stateFile,
+	})
+}
+
+// saveState saves a valid caddyfile to state file, so it can be served when docker is unreachable on startup
+func (dockerLoader *DockerLoader) saveState(contents []byte) {
+	stateFile := dockerLoader.options.stateFile
+	if stateFile == "" {
+		return
+	}
+
+	if err := writeFileAtomically(stateFile, contents); err != nil {
+		log.Printf("[ERROR] Failed to save last valid caddyfile: %v\n", err)
+	}
+}
+
+// writeFileAtomically writes to a temporary file and renames it, so a crash never leaves a truncated file
+func writeFileAtomically(path string, contents []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tempFile := path + ".tmp"
+	if err := ioutil.WriteFile(tempFile, contents, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tempFile, path)
+}
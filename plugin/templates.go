@@ -0,0 +1,258 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+)
+
+// Docker labels describing compose, stack and swarm task containers
+const (
+	composeProjectLabel      = "com.docker.compose.project"
+	composeServiceLabel      = "com.docker.compose.service"
+	composeContainerNumLabel = "com.docker.compose.container-number"
+	stackNamespaceLabel      = "com.docker.stack.namespace"
+	swarmNodeIDLabel         = "com.docker.swarm.node.id"
+	swarmServiceNameLabel    = "com.docker.swarm.service.name"
+	swarmTaskNameLabel       = "com.docker.swarm.task.name"
+)
+
+// TemplateContext is the data label templates are executed with.
+// The converted container or service is embedded for compatibility with templates like {{.Spec.Name}},
+// leaving the other one empty, but the fields and methods below keep the same meaning in container and service modes.
+type TemplateContext struct {
+	types.Container
+	swarm.Service
+
+	// Kind is container or service
+	Kind string
+	// ID of container or service
+	ID string
+	// Name of container or service
+	Name string
+	// Labels of container or service
+	Labels map[string]string
+	// LabelPrefix is the effective caddy label prefix
+	LabelPrefix string
+	// Node is the ID of swarm node running container, empty for services and containers outside swarm
+	Node string
+	// ProjectName is the compose project or stack of container or service
+	ProjectName string
+	// ServiceName is the compose or swarm service of container, or the service name
+	ServiceName string
+	// Slot is the compose container number or swarm task slot of container, 0 for services
+	Slot int
+
+	upstreams func(targetPort string, network string) ([]string, error)
+	networks  func() ([]TemplateNetwork, error)
+}
+
+// TemplateNetwork is a docker network a container or service is connected to
+type TemplateNetwork struct {
+	ID   string
+	Name string
+	IPs  []string
+}
+
+// Upstreams returns the upstream addresses used by automatic proxy generation
+func (templateContext *TemplateContext) Upstreams() ([]string, error) {
+	return templateContext.upstreams("", "")
+}
+
+// Networks returns the networks of container or service, sorted by name
+func (templateContext *TemplateContext) Networks() ([]TemplateNetwork, error) {
+	return templateContext.networks()
+}
+
+// Env returns the value of a caddy environment variable, only CADDY_DOCKER_TEMPLATE_ENV_ ones are available
+func (templateContext *TemplateContext) Env(name string) (string, error) {
+	return templateEnv(name)
+}
+
+func (g *CaddyfileGenerator) newContainerTemplateContext(container *types.Container, getProxyTargets func(targetPort string, network string) ([]string, error)) *TemplateContext {
+	name := ""
+	if len(container.Names) > 0 {
+		name = strings.TrimPrefix(container.Names[0], "/")
+	}
+
+	serviceName := container.Labels[composeServiceLabel]
+	if serviceName == "" {
+		serviceName = container.Labels[swarmServiceNameLabel]
+	}
+
+	slot, _ := strconv.Atoi(container.Labels[composeContainerNumLabel])
+	// swarm task names are service.slot.task, or service.node.task for global services
+	if taskName := container.Labels[swarmTaskNameLabel]; taskName != "" {
+		parts := strings.Split(taskName, ".")
+		if len(parts) >= 3 {
+			slot, _ = strconv.Atoi(parts[len(parts)-2])
+		}
+	}
+
+	return &TemplateContext{
+		Container:   *container,
+		Kind:        "container",
+		ID:          container.ID,
+		Name:        name,
+		Labels:      container.Labels,
+		LabelPrefix: g.labelPrefix,
+		Node:        container.Labels[swarmNodeIDLabel],
+		ProjectName: getProjectName(container.Labels),
+		ServiceName: serviceName,
+		Slot:        slot,
+		upstreams:   getProxyTargets,
+		networks: func() ([]TemplateNetwork, error) {
+			networks := []TemplateNetwork{}
+			if container.NetworkSettings == nil {
+				return networks, nil
+			}
+			for networkName, network := range container.NetworkSettings.Networks {
+				templateNetwork := TemplateNetwork{ID: network.NetworkID, Name: networkName, IPs: []string{}}
+				if network.IPAddress != "" {
+					templateNetwork.IPs = append(templateNetwork.IPs, network.IPAddress)
+				}
+				networks = append(networks, templateNetwork)
+			}
+			sortTemplateNetworks(networks)
+			return networks, nil
+		},
+	}
+}
+
+func (g *CaddyfileGenerator) newServiceTemplateContext(service *swarm.Service, getProxyTargets func(targetPort string, network string) ([]string, error)) *TemplateContext {
+	return &TemplateContext{
+		Service:     *service,
+		Kind:        "service",
+		ID:          service.ID,
+		Name:        service.Spec.Name,
+		Labels:      service.Spec.Labels,
+		LabelPrefix: g.labelPrefix,
+		ProjectName: getProjectName(service.Spec.Labels),
+		ServiceName: service.Spec.Name,
+		upstreams:   getProxyTargets,
+		networks: func() ([]TemplateNetwork, error) {
+			networks := []TemplateNetwork{}
+			for _, virtualIP := range service.Endpoint.VirtualIPs {
+				networkInfo, err := g.dockerClient.NetworkInspect(context.Background(), virtualIP.NetworkID, types.NetworkInspectOptions{})
+				if err != nil {
+					return nil, err
+				}
+				templateNetwork := TemplateNetwork{ID: virtualIP.NetworkID, Name: networkInfo.Name, IPs: []string{}}
+				if ip, _, err := net.ParseCIDR(virtualIP.Addr); err == nil {
+					templateNetwork.IPs = append(templateNetwork.IPs, ip.String())
+				}
+				networks = append(networks, templateNetwork)
+			}
+			sortTemplateNetworks(networks)
+			return networks, nil
+		},
+	}
+}
+
+func getProjectName(labels map[string]string) string {
+	if project := labels[composeProjectLabel]; project != "" {
+		return project
+	}
+	return labels[stackNamespaceLabel]
+}
+
+func sortTemplateNetworks(networks []TemplateNetwork) {
+	sort.Slice(networks, func(i, j int) bool {
+		if networks[i].Name != networks[j].Name {
+			return networks[i].Name < networks[j].Name
+		}
+		return networks[i].ID < networks[j].ID
+	})
+}
+
+// legacyNilTemplate was documented to generate empty label values, but isn't a valid template
+var legacyNilTemplate = regexp.MustCompile("{{\\s*nil\\s*}}")
+
+// templateEnvPrefix restricts env template function to variables meant for labels,
+// so label authors can't read caddy secrets, like DNS provider tokens.
+// Caddyfile placeholders of environment variables are rejected by validateLabel for the same reason.
+const templateEnvPrefix = "CADDY_DOCKER_TEMPLATE_ENV_"
+
+// templateEnv returns the value of an environment variable available to templates
+func templateEnv(name string) (string, error) {
+	if !strings.HasPrefix(name, templateEnvPrefix) {
+		return "", fmt.Errorf("environment variable %v isn't available to templates, only %v* ones are", name, templateEnvPrefix)
+	}
+	return os.Getenv(name), nil
+}
+
+// templateFuncs returns the functions available to label templates of a docker object
+func templateFuncs(getProxyTargets func(targetPort string, network string) ([]string, error)) template.FuncMap {
+	return template.FuncMap{
+		"env":     templateEnv,
+		"default": templateDefault,
+		"lower":   strings.ToLower,
+		"upper":   strings.ToUpper,
+		"replace": func(old string, new string, s string) string {
+			return strings.Replace(s, old, new, -1)
+		},
+		"split": func(sep string, s string) []string {
+			return strings.Split(s, sep)
+		},
+		"join": func(sep string, list []string) string {
+			return strings.Join(list, sep)
+		},
+		"trimPrefix": func(prefix string, s string) string {
+			return strings.TrimPrefix(s, prefix)
+		},
+		"quote": func(s string) string {
+			// like caddyfile lexer, only quotes are escaped, so backslashes of regexes and paths are kept
+			return "\"" + strings.Replace(s, "\"", "\\\"", -1) + "\""
+		},
+		"upstreams": func(targetPort ...interface{}) (string, error) {
+			if len(targetPort) > 1 {
+				return "", fmt.Errorf("upstreams expects at most one target port")
+			}
+			targetPortArg := ""
+			if len(targetPort) == 1 {
+				targetPortArg = fmt.Sprint(targetPort[0])
+			}
+			targets, err := getProxyTargets(targetPortArg, "")
+			if err != nil {
+				return "", err
+			}
+			return strings.Join(targets, " "), nil
+		},
+	}
+}
+
+// templateDefault returns value, or defaultValue when value is empty
+func templateDefault(defaultValue interface{}, value interface{}) interface{} {
+	if value == nil || fmt.Sprint(value) == "" {
+		return defaultValue
+	}
+	return value
+}
+
+// renderTemplate executes a label value template
+func renderTemplate(content string, data interface{}, funcs template.FuncMap) (string, error) {
+	if !strings.Contains(content, "{{") {
+		return content, nil
+	}
+	content = legacyNilTemplate.ReplaceAllString(content, "")
+
+	t, err := template.New("").Funcs(funcs).Parse(content)
+	if err != nil {
+		return "", err
+	}
+	var writer bytes.Buffer
+	if err := t.Execute(&writer, data); err != nil {
+		return "", err
+	}
+	return writer.String(), nil
+}
@@ -0,0 +1,184 @@
+package plugin
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTemplates_Functions(t *testing.T) {
+	os.Setenv("CADDY_DOCKER_TEMPLATE_ENV_DOMAIN", "example.com")
+	defer os.Unsetenv("CADDY_DOCKER_TEMPLATE_ENV_DOMAIN")
+
+	funcs := templateFuncs(func(targetPort string, network string) ([]string, error) {
+		return addTargetPort([]string{"172.17.0.2", "172.17.0.3"}, targetPort), nil
+	})
+	data := struct{ Name string }{Name: "My_Service"}
+
+	testCases := map[string]string{
+		`{{env "CADDY_DOCKER_TEMPLATE_ENV_DOMAIN"}}`:                  "example.com",
+		`{{env "CADDY_DOCKER_TEMPLATE_ENV_MISSING" | default "a.b"}}`: "a.b",
+		`{{.Name | lower}} {{.Name | upper}}`:                         "my_service MY_SERVICE",
+		`{{.Name | replace "_" "-"}}`:                                 "My-Service",
+		`{{split "," "a,b" | join " "}}`:                              "a b",
+		`{{.Name | trimPrefix "My_"}}`:                                "Service",
+		`{{quote "a \"b\""}}`:                                         `"a \"b\""`,
+		`/ {{upstreams}}`:                                             "/ 172.17.0.2 172.17.0.3",
+		`/ {{upstreams 8080}}`:                                        "/ 172.17.0.2:8080 172.17.0.3:8080",
+		`^/(.*)$ /x?a=1&b=<'+'>`:                                      `^/(.*)$ /x?a=1&b=<'+'>`,
+		`{{"a&b<c>'d'+e"}}`:                                           `a&b<c>'d'+e`,
+		`{{nil}}`:                                                     "",
+	}
+
+	for content, expected := range testCases {
+		result, err := renderTemplate(content, data, funcs)
+		assert.NoError(t, err, content)
+		assert.Equal(t, expected, result, content)
+	}
+
+	os.Setenv("CADDY_DOCKER_TEST_SECRET", "secret")
+	defer os.Unsetenv("CADDY_DOCKER_TEST_SECRET")
+
+	result, err := renderTemplate(`{{env "CADDY_DOCKER_TEST_SECRET"}}`, data, funcs)
+	assert.Empty(t, result)
+	assert.Contains(t, err.Error(), "error calling env: environment variable CADDY_DOCKER_TEST_SECRET isn't available to templates, only CADDY_DOCKER_TEMPLATE_ENV_* ones are")
+}
+
+func TestTemplates_QuoteRoundTripsThroughLabelArguments(t *testing.T) {
+	funcs := templateFuncs(nil)
+	data := struct{ Value string }{}
+
+	for _, value := range []string{`^/api/(\d+)$`, `C:\dir`, `a "b" c`, `{"a": "b c"}`, ""} {
+		data.Value = value
+		result, err := renderTemplate(`{{quote .Value}}`, data, funcs)
+		assert.NoError(t, err, value)
+		assert.Equal(t, []string{value}, parseArgs(result), value)
+	}
+}
+
+func TestTemplates_ReportsErrorsPerContainer(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ContainersData = []types.Container{
+		types.Container{
+			ID: "container-a",
+			NetworkSettings: &types.SummaryNetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"caddy-network": &network.EndpointSettings{
+						IPAddress: "172.17.0.2",
+						NetworkID: caddyNetworkID,
+					},
+				},
+			},
+			Labels: map[string]string{
+				fmtLabel("%s.address"): "service.testdomain.com",
+				fmtLabel("%s.tls"):     "off",
+			},
+		},
+		types.Container{
+			ID:    "container-b",
+			Names: []string{"/broken"},
+			Labels: map[string]string{
+				fmtLabel("%s"):        "broken.testdomain.com",
+				fmtLabel("%s.header"): "/ X-Test {{.Unknown}}",
+			},
+		},
+	}
+
+	const expectedCaddyfile = "service.testdomain.com {\n" +
+		"  proxy / 172.17.0.2\n" +
+		"  tls off\n" +
+		"}\n"
+
+	const expectedLogs = skipCaddyfileText +
+		"[ERROR] Invalid label caddy.header of container broken (container-b): " +
+		"template: :1:11: executing \"\" at <.Unknown>: can't evaluate field Unknown in type *plugin.TemplateContext\n"
+
+	testGeneration(t, dockerClient, false, true, expectedCaddyfile, expectedLogs)
+}
+
+func TestTemplates_UpstreamsErrors(t *testing.T) {
+	funcs := templateFuncs(func(targetPort string, network string) ([]string, error) {
+		return nil, fmt.Errorf("Container container-id and caddy are not in same network")
+	})
+
+	_, err := renderTemplate("/ {{upstreams}}", nil, funcs)
+	assert.EqualError(t, err, "template: :1:4: executing \"\" at <upstreams>: error calling upstreams: Container container-id and caddy are not in same network")
+}
+
+func TestTemplates_ContainerContext(t *testing.T) {
+	os.Setenv("CADDY_DOCKER_TEMPLATE_ENV_DOMAIN", "testdomain.com")
+	defer os.Unsetenv("CADDY_DOCKER_TEMPLATE_ENV_DOMAIN")
+
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ContainersData = []types.Container{
+		types.Container{
+			ID:    "container-id",
+			Names: []string{"/web-2"},
+			NetworkSettings: &types.SummaryNetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"caddy-network": &network.EndpointSettings{
+						IPAddress: "172.17.0.2",
+						NetworkID: caddyNetworkID,
+					},
+				},
+			},
+			Labels: map[string]string{
+				"com.docker.compose.project": "shop",
+				"com.docker.compose.service": "web",
+				"com.docker.swarm.node.id":   "node-1",
+				"com.docker.swarm.task.name": "shop_web.2.abc",
+				fmtLabel("%s"):               "{{.Name}}.{{.ProjectName}}.{{.Env \"CADDY_DOCKER_TEMPLATE_ENV_DOMAIN\"}}",
+				fmtLabel("%s.header_0"):      "/ X-Info {{.Kind}}-{{.ServiceName}}-{{.Slot}}-{{.Node}}-{{.LabelPrefix}}",
+				fmtLabel("%s.header_1"):      "/ X-Networks {{range .Networks}}{{.Name}}={{join \",\" .IPs}}{{end}}",
+				fmtLabel("%s.header_2"):      "/ X-Upstreams {{join \",\" .Upstreams}}",
+			},
+		},
+	}
+
+	const expectedCaddyfile = "web-2.shop.testdomain.com {\n" +
+		"  header / X-Info container-web-2-node-1-caddy\n" +
+		"  header / X-Networks caddy-network=172.17.0.2\n" +
+		"  header / X-Upstreams 172.17.0.2\n" +
+		"}\n"
+
+	testGeneration(t, dockerClient, false, true, expectedCaddyfile, skipCaddyfileText)
+}
+
+func TestTemplates_ServiceContext(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.NetworkInspectData[caddyNetworkID] = types.NetworkResource{Name: "caddy-network"}
+	dockerClient.ServicesData = []swarm.Service{
+		swarm.Service{
+			ID: "service-id",
+			Spec: swarm.ServiceSpec{
+				Annotations: swarm.Annotations{
+					Name: "shop_api",
+					Labels: map[string]string{
+						"com.docker.stack.namespace": "shop",
+						fmtLabel("%s"):               "{{.ServiceName}}.{{.ProjectName}}.testdomain.com",
+						fmtLabel("%s.header"):        "/ X-Info {{.Kind}}-{{.Name}}-{{.Slot}} {{range .Networks}}{{.Name}}={{join \",\" .IPs}}{{end}} {{join \",\" .Upstreams}}",
+					},
+				},
+			},
+			Endpoint: swarm.Endpoint{
+				VirtualIPs: []swarm.EndpointVirtualIP{
+					swarm.EndpointVirtualIP{
+						NetworkID: caddyNetworkID,
+						Addr:      "10.0.0.5/24",
+					},
+				},
+			},
+		},
+	}
+
+	const expectedCaddyfile = "shop_api.shop.testdomain.com {\n" +
+		"  header / X-Info service-shop_api-0 caddy-network=10.0.0.5 shop_api\n" +
+		"}\n"
+
+	testGeneration(t, dockerClient, false, true, expectedCaddyfile, skipCaddyfileText)
+}